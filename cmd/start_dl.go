@@ -7,9 +7,12 @@ import (
 	"github.com/spf13/cobra"
 	"log"
 	"minodl/config"
+	"minodl/dao"
 	"minodl/mdb"
 	"minodl/models"
 	"minodl/router"
+	"minodl/service"
+	"minodl/storage"
 	"net/http"
 	"os"
 	"os/signal"
@@ -33,11 +36,29 @@ var dl = &cobra.Command{
 		if err != nil {
 			log.Fatalf("db init: %v", err)
 		}
-		err = mdb.Mysql.AutoMigrate(&models.User{}, &models.Task{})
+		if err = dao.MigrateProgressColumns(); err != nil {
+			log.Fatalf("db migrate progress: %v", err)
+		}
+		err = mdb.Mysql.AutoMigrate(&models.User{}, &models.Task{}, &models.MediaCache{}, &models.SiteCredential{},
+			&models.Subscription{}, &models.SubscriptionEntry{})
 		if err != nil {
 			log.Fatalf("db migrate: %v", err)
 		}
-		_ = mdb.InitRedis(cfg)
+		rdb := mdb.InitRedis(cfg)
+		// 多节点任务事件转发
+		service.Events.Relay(rdb)
+		// 媒体存储
+		if _, err = storage.Init(cfg); err != nil {
+			log.Fatalf("storage init: %v", err)
+		}
+		// 后台下载队列
+		queue := service.InitDownloadQueue(cfg)
+		// 媒体缓存淘汰
+		janitor := service.InitMediaCache(cfg)
+		// 封面镜像清理
+		covers := service.InitThumbnails()
+		// 订阅拉取
+		subscriptions := service.InitSubscriptions()
 		// 初始化API服务
 		r := router.DownloadApi()
 		srv := &http.Server{
@@ -59,6 +80,10 @@ var dl = &cobra.Command{
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		_ = srv.Shutdown(ctx)
+		queue.Stop()
+		janitor.Stop()
+		covers.Stop()
+		subscriptions.Stop()
 	},
 	PreRun: func(cmd *cobra.Command, args []string) {
 	},
@@ -9,11 +9,34 @@ import (
 var cfgFile *string = flag.String("c", "config.json", "config file")
 
 type Config struct {
-	MysqlDSN   string `json:"mysqldsn"`
-	RedisDSN   string `json:"redisdsn"`
-	ListenAddr string `json:"listen_addr"`
-	Slat       string `json:"slat"`
-	JWTSecret  string `json:"jwt_secret"`
+	MysqlDSN        string        `json:"mysqldsn"`
+	RedisDSN        string        `json:"redisdsn"`
+	ListenAddr      string        `json:"listen_addr"`
+	PublicURL       string        `json:"public_url"` // 对外访问地址，用于拼接封面等绝对地址，为空时返回相对路径
+	Slat            string        `json:"slat"`
+	JWTSecret       string        `json:"jwt_secret"`
+	SignSecret      string        `json:"sign_secret"`      // 签名链接密钥，为空时使用 jwt_secret
+	AdminToken      string        `json:"admin_token"`      // 管理接口令牌，通过 X-Admin-Token 传入，为空时关闭管理接口
+	CredentialKey   string        `json:"credential_key"`   // 加密用户上传的站点 cookie 和密码，为空时使用 jwt_secret
+	DownloadDir     string        `json:"download_dir"`     // 后台下载文件目录
+	DownloadWorkers int           `json:"download_workers"` // 全局并发下载数
+	CacheMaxBytes   int64         `json:"cache_max_bytes"`  // 媒体缓存上限，字节，0 表示不淘汰
+	HLSDir          string        `json:"hls_dir"`          // HLS 切片临时目录
+	Storage         StorageConfig `json:"storage"`
+}
+
+// StorageConfig 媒体存储后端，driver: local | s3
+type StorageConfig struct {
+	Driver     string `json:"driver"`
+	LocalDir   string `json:"local_dir"`
+	BaseURL    string `json:"base_url"` // 公开访问前缀（CDN），为空时通过 API 下载或预签名
+	Endpoint   string `json:"endpoint"`
+	Region     string `json:"region"`
+	Bucket     string `json:"bucket"`
+	AccessKey  string `json:"access_key"`
+	SecretKey  string `json:"secret_key"`
+	PathStyle  bool   `json:"path_style"`  // MinIO 等需要 path-style
+	PresignTTL int    `json:"presign_ttl"` // 预签名有效期，秒
 }
 
 var cfg *Config
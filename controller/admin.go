@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"errors"
+	"minodl/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InvalidateParseCache 删除解析缓存：?url= 删除单个链接，?all=1 清空全部
+func InvalidateParseCache(c *gin.Context) {
+	var (
+		n   int64
+		err error
+	)
+	switch {
+	case c.Query("url") != "":
+		n, err = service.InvalidateParseCache(c.Request.Context(), c.Query("url"))
+	case c.Query("all") == "1":
+		n, err = service.ClearParseCache(c.Request.Context())
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url or all=1 required"})
+		return
+	}
+	if errors.Is(err, service.ErrNoShareURL) || errors.Is(err, service.ErrShortLink) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"minodl/service"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListCredentials 用户保存的站点登录信息，不返回 cookie 和密码
+func ListCredentials(c *gin.Context) {
+	list, err := service.ListCredentials(c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"credentials": list})
+}
+
+// SaveCredential 上传某个站点的登录信息：multipart 的 cookies 文件（Netscape 格式），
+// 或 JSON {"cookies": "..."} / {"username": "...", "password": "..."}
+func SaveCredential(c *gin.Context) {
+	var in service.CredentialInput
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fh, err := c.FormFile("cookies")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cookies file required"})
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, 1<<20+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		in.Cookies = string(data)
+	} else if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cred, err := service.SaveCredential(c.GetUint("user_id"), c.Param("domain"), in)
+	if err != nil {
+		if errors.Is(err, service.ErrCredentialInput) || errors.Is(err, service.ErrCredentialDomain) ||
+			errors.Is(err, service.ErrNoSiteCookies) || errors.Is(err, service.ErrCookiesExpired) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"credential": cred})
+}
+
+func DeleteCredential(c *gin.Context) {
+	ok, err := service.DeleteCredential(c.GetUint("user_id"), c.Param("domain"))
+	if err != nil {
+		if errors.Is(err, service.ErrCredentialDomain) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
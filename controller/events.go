@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"io"
+	"minodl/models"
+	"minodl/service"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sseKeepAlive = 15 * time.Second
+
+// TaskEvents 单个任务的 SSE 进度推送，连接时先回放当前状态
+func TaskEvents(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	id, _ := strconv.Atoi(c.Param("id"))
+	t, err := service.GetTask(uid, uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	ch, cancel := service.Events.SubscribeTask(t.ID)
+	defer cancel()
+	streamEvents(c, []service.TaskEvent{service.Events.Snapshot(t)}, ch)
+}
+
+// UserEvents 当前用户所有任务的 SSE 推送，回放未结束任务的状态
+func UserEvents(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	ch, cancel := service.Events.SubscribeUser(uid)
+	defer cancel()
+	tasks, err := service.ListTasks(uid, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	replay := make([]service.TaskEvent, 0)
+	for i := range tasks {
+		if tasks[i].Status == models.StatusPending || tasks[i].Status == models.StatusRunning {
+			replay = append(replay, service.Events.Snapshot(&tasks[i]))
+		}
+	}
+	streamEvents(c, replay, ch)
+}
+
+func streamEvents(c *gin.Context, replay []service.TaskEvent, ch <-chan service.TaskEvent) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	for _, ev := range replay {
+		c.SSEvent(ev.Type, ev)
+	}
+	c.Writer.Flush()
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case ev := <-ch:
+			c.SSEvent(ev.Type, ev)
+		case <-ticker.C:
+			c.SSEvent("ping", time.Now().Unix())
+		}
+		return true
+	})
+}
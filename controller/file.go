@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"errors"
+	"minodl/models"
+	"minodl/service"
+	"minodl/storage"
+	"minodl/utils"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DownloadTask 下载已完成任务的文件，支持 Range/If-Range/ETag/Last-Modified 断点续传
+func DownloadTask(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	id, _ := strconv.Atoi(c.Param("id"))
+	t, err := service.GetTask(uid, uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	// ?disposition=inline 时浏览器/播放器直接播放
+	ServeTaskFile(c, t, c.Query("disposition") == "inline")
+}
+
+// taskFileKey 有后处理输出时默认返回处理后的文件，?variant=original 取原始下载
+func taskFileKey(c *gin.Context, t *models.Task) string {
+	if t.ProcessedPath != "" && c.Query("variant") != "original" {
+		return t.ProcessedPath
+	}
+	return t.FilePath
+}
+
+// ServeTaskFile 从存储后端输出已完成任务的文件
+func ServeTaskFile(c *gin.Context, t *models.Task, inline bool) {
+	if t.Status != models.StatusCompleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "task is not completed"})
+		return
+	}
+	if t.FilePath == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	key := taskFileKey(c, t)
+	serveObject(c, key, t.Title+path.Ext(key), inline)
+}
+
+// TaskSubtitle 下载任务的字幕文件，?disposition=inline 时直接显示
+func TaskSubtitle(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	id, _ := strconv.Atoi(c.Param("id"))
+	t, err := service.GetTask(uid, uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	lang := c.Param("lang")
+	key := service.SubtitleKey(t, lang)
+	if key == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subtitle not found"})
+		return
+	}
+	ext := path.Ext(key)
+	if ext == ".vtt" {
+		c.Header("Content-Type", "text/vtt; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-subrip; charset=utf-8")
+	}
+	serveObject(c, key, t.Title+"."+lang+ext, c.Query("disposition") == "inline")
+}
+
+// serveObject 输出存储对象，filename 为下载时的文件名
+func serveObject(c *gin.Context, key, filename string, inline bool) {
+	obj, err := storage.Store.Open(c.Request.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	defer obj.Close()
+	info := obj.Info()
+	kind := "attachment"
+	if inline {
+		kind = "inline"
+	}
+	c.Header("Content-Disposition", utils.ContentDisposition(kind, filename))
+	if info.ETag != "" {
+		c.Header("ETag", info.ETag)
+	}
+	c.Header("Cache-Control", "private, max-age=3600")
+	// ServeContent 处理 Range、If-Range、If-None-Match 和 Last-Modified
+	http.ServeContent(c.Writer, c.Request, path.Base(key), info.ModTime, obj)
+}
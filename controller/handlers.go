@@ -1,8 +1,10 @@
 package controller
 
 import (
+	"errors"
 	"minodl/config"
 	"minodl/dao"
+	"minodl/log"
 	"minodl/models"
 	"minodl/service"
 	"net/http"
@@ -25,7 +27,15 @@ type LoginReq struct {
 }
 
 type CreateTaskReq struct {
-	Url string `json:"url" binding:"required"`
+	// link, or share text containing one
+	Url     string `json:"url" binding:"required"`
+	Format  string `json:"format"`  // format_id or quality label from the parse result
+	Profile string `json:"profile"` // post-processing profile, see GET /api/profiles
+	Entries []int  `json:"entries"` // playlist entry indexes to include, all when empty
+	// subtitle tracks to download, see "subtitles" in the parse result
+	Subtitles *service.SubtitleOptions `json:"subtitles"`
+	// RFC 3339, queue the download no earlier than this (off-peak)
+	NotBefore *time.Time `json:"not_before"`
 }
 
 func GetPrivacy(c *gin.Context) {
@@ -80,7 +90,56 @@ func GetProfile(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid uid"})
 		return
 	}
-	c.JSON(http.StatusOK, u)
+	// 用量读取失败时仍返回用户信息
+	usage, err := service.GetQuotaUsage(u)
+	if err != nil {
+		log.Error("get quota usage user:%d err:%v", uid, err)
+	}
+	c.JSON(http.StatusOK, struct {
+		*models.User
+		Usage *service.QuotaUsage `json:"usage,omitempty"`
+	}{u, usage})
+}
+
+// quotaExceeded 超出套餐额度时返回 429，带上限、剩余和重置时间
+func quotaExceeded(c *gin.Context, err error) bool {
+	var qe *service.QuotaError
+	if !errors.As(err, &qe) {
+		return false
+	}
+	if qe.ResetAt != nil {
+		c.Header("Retry-After", strconv.Itoa(int(time.Until(*qe.ResetAt).Seconds())+1))
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": qe.Error(), "quota": qe})
+	return true
+}
+
+type ParseReq struct {
+	Url string `json:"url" binding:"required"` // link, or share text containing one
+}
+
+// ParseVideo 解析链接，返回标题、时长和可选清晰度
+func ParseVideo(c *gin.Context) {
+	var req ParseReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	info, err := service.ParseVideoInfo(c.GetUint("user_id"), req.Url)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"video": info})
+}
+
+func ListProfiles(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"profiles": service.Profiles()})
+}
+
+// ListSites 支持的站点及各自的能力
+func ListSites(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"sites": service.Sites()})
 }
 
 func CreateTask(c *gin.Context) {
@@ -90,21 +149,72 @@ func CreateTask(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	t, err := service.CreateTaskForUser(uid, req.Url)
+	t, err := service.CreateTaskForUser(uid, req.Url, service.TaskOptions{
+		Format:    req.Format,
+		Profile:   req.Profile,
+		Entries:   req.Entries,
+		Subtitles: req.Subtitles,
+		NotBefore: req.NotBefore,
+	})
+	if quotaExceeded(c, err) {
+		return
+	}
+	if errors.Is(err, service.ErrPlanQuality) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, service.ErrScheduleTooFar) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	service.ResolveURLs(t)
 	c.JSON(http.StatusOK, gin.H{"task": t})
 }
 
+type BatchCreateReq struct {
+	Urls      []string                 `json:"urls" binding:"required"`
+	Format    string                   `json:"format"`
+	Profile   string                   `json:"profile"`
+	Subtitles *service.SubtitleOptions `json:"subtitles"`
+	NotBefore *time.Time               `json:"not_before"`
+}
+
+// CreateTasksBatch 批量创建任务，逐个返回创建结果或错误
+func CreateTasksBatch(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	var req BatchCreateReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	items, err := service.CreateTasksBatch(uid, req.Urls, service.TaskOptions{Format: req.Format, Profile: req.Profile, Subtitles: req.Subtitles, NotBefore: req.NotBefore})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range items {
+		if items[i].Task != nil {
+			service.ResolveURLs(items[i].Task)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
 func ListTasks(c *gin.Context) {
 	uid := c.GetUint("user_id")
-	tasks, err := service.ListTasks(uid)
+	parentID, _ := strconv.Atoi(c.Query("parent_id"))
+	tasks, err := service.ListTasks(uid, uint(parentID))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	for i := range tasks {
+		service.ResolveURLs(&tasks[i])
+	}
 	c.JSON(http.StatusOK, gin.H{"tasks": tasks})
 }
 
@@ -116,23 +226,10 @@ func GetTask(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
+	service.ResolveURLs(t)
 	c.JSON(http.StatusOK, gin.H{"task": t})
 }
 
-func MarkTaskComplete(c *gin.Context) {
-	id, _ := strconv.Atoi(c.Param("id"))
-	var body struct {
-		FilePath string `json:"file_path"`
-		VideoURL string `json:"video_url"`
-	}
-	_ = c.BindJSON(&body)
-	if err := service.MarkComplete(uint(id), body.FilePath, body.VideoURL); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
-}
-
 func StreamTask(c *gin.Context) {
 	uid := c.GetUint("user_id")
 	id, _ := strconv.Atoi(c.Param("id"))
@@ -141,27 +238,69 @@ func StreamTask(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
+	streamTask(c, t)
+}
+
+func streamTask(c *gin.Context, t *models.Task) {
+	if t.ChildCount > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "playlist task, stream its entries instead"})
+		return
+	}
+	// 已完成的任务直接播放落盘文件
 	if t.Status == models.StatusCompleted {
-		c.JSON(http.StatusConflict, gin.H{"msg": "this task is already completed"})
+		ServeTaskFile(c, t, true)
 		return
 	}
 	HandleStream(c, t)
 }
 
 func StartTask(c *gin.Context) {
-	// TODO save to cloud disk
-	/*uid := c.GetUint("user_id")
+	uid := c.GetUint("user_id")
 	id, _ := strconv.Atoi(c.Param("id"))
 	t, err := service.GetTask(uid, uint(id))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
-	if err := service.StartDownloadTask(context.Background(), t); err != nil {
+	if err := service.StartDownloadTask(t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func CancelTask(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	id, _ := strconv.Atoi(c.Param("id"))
+	t, err := service.CancelTask(uid, uint(id))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	service.ResolveURLs(t)
+	c.JSON(http.StatusOK, gin.H{"task": t})
+}
+
+func DeleteTask(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := service.DeleteTask(uid, uint(id)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+func RetryTask(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	id, _ := strconv.Atoi(c.Param("id"))
+	t, err := service.RetryTask(uid, uint(id))
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})*/
+	service.ResolveURLs(t)
+	c.JSON(http.StatusOK, gin.H{"task": t})
 }
 
 // Helper: JWT generation
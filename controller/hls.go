@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"errors"
+	"minodl/models"
+	"minodl/service"
+	"minodl/storage"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mp4":  "video/mp4",
+	".m4s":  "video/iso.segment",
+	".ts":   "video/mp2t",
+}
+
+// TaskHLS HLS 播放列表和切片，未完成的任务边下边切
+func TaskHLS(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	id, _ := strconv.Atoi(c.Param("id"))
+	t, err := service.GetTask(uid, uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	serveHLS(c, t, "")
+}
+
+// serveHLS query 非空时追加到播放列表中的切片地址
+func serveHLS(c *gin.Context, t *models.Task, query string) {
+	if t.ChildCount > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "playlist task, play its entries instead"})
+		return
+	}
+	file := c.Param("file")
+	p, err := service.OpenHLS(c.Request.Context(), t, c.Param("kind"), file)
+	if quotaExceeded(c, err) {
+		return
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, service.ErrHLSKind), errors.Is(err, service.ErrHLSFile):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, service.ErrStreamStarted):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, storage.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "segment not ready"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ext := path.Ext(file)
+	c.Header("Content-Type", hlsContentTypes[ext])
+	if ext == ".m3u8" {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if query != "" {
+			data = service.SignPlaylist(data, query)
+		}
+		// 播放列表在切片过程中不断追加
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, hlsContentTypes[ext], data)
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.File(p)
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"errors"
+	"minodl/models"
+	"minodl/service"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SignTask 签发短期播放/下载链接，?action=stream|download|hls&ttl=秒
+func SignTask(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	id, _ := strconv.Atoi(c.Param("id"))
+	action := c.DefaultQuery("action", service.SignedStream)
+	ttl, _ := strconv.Atoi(c.Query("ttl"))
+	signed, err := service.SignTaskURL(uid, uint(id), action, time.Duration(ttl)*time.Second)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, signed)
+}
+
+// SignedStream 公开路由，校验签名后推流
+func SignedStream(c *gin.Context) {
+	if t, ok := verifySigned(c, service.SignedStream); ok {
+		streamTask(c, t)
+	}
+}
+
+// SignedDownload 公开路由，校验签名后输出文件
+func SignedDownload(c *gin.Context) {
+	if t, ok := verifySigned(c, service.SignedDownload); ok {
+		ServeTaskFile(c, t, c.Query("disposition") == "inline")
+	}
+}
+
+// SignedHLS 公开路由，播放列表中的切片地址带上同样的签名
+func SignedHLS(c *gin.Context) {
+	if t, ok := verifySigned(c, service.SignedHLS); ok {
+		q := url.Values{}
+		q.Set("uid", c.Query("uid"))
+		q.Set("exp", c.Query("exp"))
+		q.Set("sig", c.Query("sig"))
+		serveHLS(c, t, q.Encode())
+	}
+}
+
+func verifySigned(c *gin.Context, action string) (*models.Task, bool) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	t, err := service.VerifyTaskURL(uint(id), action, c.Query("uid"), c.Query("exp"), c.Query("sig"))
+	switch {
+	case err == nil:
+		return t, true
+	case errors.Is(err, service.ErrSignature), errors.Is(err, service.ErrExpired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	}
+	return nil, false
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"errors"
+	"minodl/service"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func ListSubscriptions(c *gin.Context) {
+	list, err := service.ListSubscriptions(c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscriptions": list})
+}
+
+// CreateSubscription 关注频道或播放列表，之后发布的作品自动下载
+func CreateSubscription(c *gin.Context) {
+	var in service.SubscriptionInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s, err := service.CreateSubscription(c.GetUint("user_id"), in)
+	if err != nil {
+		if errors.Is(err, service.ErrSubscriptionInput) || errors.Is(err, service.ErrSubscriptionSource) ||
+			errors.Is(err, service.ErrNoShareURL) || errors.Is(err, service.ErrShortLink) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscription": s})
+}
+
+func UpdateSubscription(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var in service.SubscriptionUpdate
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s, err := service.UpdateSubscription(c.GetUint("user_id"), uint(id), in)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		case errors.Is(err, service.ErrSubscriptionInput):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscription": s})
+}
+
+// DeleteSubscription 停止关注，已创建的任务保留
+func DeleteSubscription(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	ok, err := service.DeleteSubscription(c.GetUint("user_id"), uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"errors"
+	"minodl/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetThumbnail 输出镜像的封面，文件名由原始地址哈希得到，内容不会变
+func GetThumbnail(c *gin.Context) {
+	name := c.Param("name")
+	obj, err := service.OpenThumbnail(c.Request.Context(), name)
+	if err != nil {
+		if errors.Is(err, service.ErrCoverNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		} else {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	defer obj.Close()
+	info := obj.Info()
+	if info.ETag != "" {
+		c.Header("ETag", info.ETag)
+	}
+	c.Header("Cache-Control", "public, max-age=604800, immutable")
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime, obj)
+}
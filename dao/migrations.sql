@@ -3,6 +3,7 @@ CREATE TABLE IF NOT EXISTS users (
   id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
   email VARCHAR(255) NOT NULL UNIQUE,
   password VARCHAR(255) NOT NULL,
+  plan VARCHAR(32) DEFAULT 'FREE',
   created_at DATETIME,
   updated_at DATETIME
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -14,11 +15,150 @@ CREATE TABLE IF NOT EXISTS tasks (
   source_url VARCHAR(1024),
   video_url VARCHAR(1024),
   status VARCHAR(32),
-  progress FLOAT,
+  progress DOUBLE DEFAULT 0,
   file_path VARCHAR(1024),
   error_msg VARCHAR(1024),
+  error_code VARCHAR(32),
+  attempts INT DEFAULT 0,
+  next_retry_at DATETIME NULL,
+  priority INT DEFAULT 0,
+  format VARCHAR(64),
+  format_spec VARCHAR(255),
+  duration INT DEFAULT 0,
+  stage VARCHAR(16),
+  downloaded_bytes BIGINT DEFAULT 0,
+  total_bytes BIGINT DEFAULT 0,
+  speed DOUBLE DEFAULT 0,
+  eta INT DEFAULT 0,
+  profile VARCHAR(32),
+  profile_status VARCHAR(32),
+  profile_progress DOUBLE DEFAULT 0,
+  processed_path VARCHAR(1024),
+  sub_langs VARCHAR(255),
+  sub_auto TINYINT(1) DEFAULT 0,
+  sub_format VARCHAR(8),
+  sub_mode VARCHAR(8),
+  subtitle_paths TEXT,
+  parent_id BIGINT UNSIGNED DEFAULT 0,
+  child_count INT DEFAULT 0,
+  not_before DATETIME NULL,
+  subscription_id BIGINT UNSIGNED DEFAULT 0,
+  cache_key VARCHAR(64),
+  cache_id BIGINT UNSIGNED DEFAULT 0,
+  cached TINYINT(1) DEFAULT 0,
   created_at DATETIME,
   updated_at DATETIME,
+  deleted_at DATETIME NULL,
   INDEX(user_id),
-  INDEX(status)
+  INDEX(status),
+  INDEX(deleted_at),
+  INDEX(parent_id),
+  INDEX(cache_key),
+  INDEX(cache_id),
+  INDEX(subscription_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS media_caches (
+  id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+  cache_key VARCHAR(64) NOT NULL UNIQUE,
+  source_url VARCHAR(1024),
+  format_spec VARCHAR(255),
+  profile VARCHAR(32),
+  file_path VARCHAR(1024),
+  processed_path VARCHAR(1024),
+  subtitle_paths TEXT,
+  sha256 VARCHAR(64),
+  size BIGINT DEFAULT 0,
+  ref_count INT DEFAULT 0,
+  last_used_at DATETIME,
+  created_at DATETIME,
+  updated_at DATETIME,
+  INDEX(sha256),
+  INDEX(ref_count),
+  INDEX(last_used_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS site_credentials (
+  id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT UNSIGNED NOT NULL,
+  domain VARCHAR(255) NOT NULL,
+  kind VARCHAR(16),
+  secret TEXT,
+  username VARCHAR(255),
+  cookie_count INT DEFAULT 0,
+  expires_at DATETIME NULL,
+  status VARCHAR(16),
+  last_error VARCHAR(1024),
+  last_used_at DATETIME NULL,
+  created_at DATETIME,
+  updated_at DATETIME,
+  UNIQUE KEY idx_user_domain (user_id, domain)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+  id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT UNSIGNED NOT NULL,
+  source_url VARCHAR(1024),
+  title VARCHAR(255),
+  poll_interval INT DEFAULT 0,
+  keyword VARCHAR(255),
+  max_duration INT DEFAULT 0,
+  format VARCHAR(64),
+  enabled TINYINT(1) DEFAULT 1,
+  next_poll_at DATETIME,
+  last_polled_at DATETIME NULL,
+  last_error VARCHAR(1024),
+  created_at DATETIME,
+  updated_at DATETIME,
+  INDEX(user_id),
+  INDEX(next_poll_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS subscription_entries (
+  id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+  subscription_id BIGINT UNSIGNED NOT NULL,
+  video_id VARCHAR(255) NOT NULL,
+  task_id BIGINT UNSIGNED DEFAULT 0,
+  created_at DATETIME,
+  UNIQUE KEY idx_sub_video (subscription_id, video_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- upgrade: databases created from an earlier version of this file. New tables are created by the
+-- CREATE TABLE IF NOT EXISTS statements above; run the statements below in order, skipping the
+-- steps that are already applied.
+--
+-- 1. plans and queue priority
+-- ALTER TABLE users ADD plan VARCHAR(32) DEFAULT 'FREE';
+-- ALTER TABLE tasks ADD priority INT DEFAULT 0;
+--
+-- 2. quality selection
+-- ALTER TABLE tasks ADD format VARCHAR(64), ADD format_spec VARCHAR(255);
+--
+-- 3. post-processing profiles (profile_progress is converted to DOUBLE in step 7)
+-- ALTER TABLE tasks ADD duration INT DEFAULT 0, ADD profile VARCHAR(32), ADD profile_status VARCHAR(32),
+--   ADD profile_progress VARCHAR(16), ADD processed_path VARCHAR(1024);
+--
+-- 4. playlists
+-- ALTER TABLE tasks ADD parent_id BIGINT UNSIGNED DEFAULT 0, ADD child_count INT DEFAULT 0, ADD INDEX(parent_id);
+--
+-- 5. failure codes and automatic retries
+-- ALTER TABLE tasks ADD error_code VARCHAR(32), ADD attempts INT DEFAULT 0, ADD next_retry_at DATETIME NULL;
+--
+-- 6. media cache and soft delete
+-- ALTER TABLE tasks ADD cache_key VARCHAR(64), ADD cache_id BIGINT UNSIGNED DEFAULT 0, ADD cached TINYINT(1) DEFAULT 0,
+--   ADD deleted_at DATETIME NULL, ADD INDEX(deleted_at), ADD INDEX(cache_key), ADD INDEX(cache_id);
+--
+-- 7. structured progress; progress and profile_progress used to be strings, clean them before converting
+-- UPDATE tasks SET progress = '0' WHERE progress IS NULL OR progress NOT REGEXP '^[0-9]+([.][0-9]+)?$';
+-- UPDATE tasks SET profile_progress = '0' WHERE profile_progress IS NULL OR profile_progress NOT REGEXP '^[0-9]+([.][0-9]+)?$';
+-- ALTER TABLE tasks MODIFY progress DOUBLE DEFAULT 0, MODIFY profile_progress DOUBLE DEFAULT 0,
+--   ADD stage VARCHAR(16), ADD downloaded_bytes BIGINT DEFAULT 0, ADD total_bytes BIGINT DEFAULT 0,
+--   ADD speed DOUBLE DEFAULT 0, ADD eta INT DEFAULT 0;
+--
+-- 8. subtitles
+-- ALTER TABLE tasks ADD sub_langs VARCHAR(255), ADD sub_auto TINYINT(1) DEFAULT 0, ADD sub_format VARCHAR(8),
+--   ADD sub_mode VARCHAR(8), ADD subtitle_paths TEXT;
+-- ALTER TABLE media_caches ADD subtitle_paths TEXT;
+--
+-- 9. scheduled and subscription tasks
+-- ALTER TABLE tasks ADD not_before DATETIME NULL, ADD subscription_id BIGINT UNSIGNED DEFAULT 0, ADD INDEX(subscription_id);
@@ -2,9 +2,18 @@ package dao
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"minodl/mdb"
 	"minodl/models"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func CreateUser(u *models.User) error {
@@ -27,6 +36,34 @@ func GetUserById(uid int64) (*models.User, error) {
 	return &u, nil
 }
 
+// MigrateProgressColumns progress、profile_progress 原来是字符串，
+// AutoMigrate 改为数值列之前先把无法转换的值置 0，已有数据不丢失
+func MigrateProgressColumns() error {
+	m := mdb.Mysql.Migrator()
+	if !m.HasTable(&models.Task{}) {
+		return nil
+	}
+	columns, err := m.ColumnTypes(&models.Task{})
+	if err != nil {
+		return err
+	}
+	for _, col := range columns {
+		name := col.Name()
+		if name != "progress" && name != "profile_progress" {
+			continue
+		}
+		typ := strings.ToLower(col.DatabaseTypeName())
+		if !strings.Contains(typ, "char") && !strings.Contains(typ, "text") {
+			continue
+		}
+		sql := fmt.Sprintf("UPDATE tasks SET %[1]s = '0' WHERE %[1]s IS NULL OR %[1]s NOT REGEXP '^[0-9]+([.][0-9]+)?$'", name)
+		if err = mdb.Mysql.Exec(sql).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func CreateTask(t *models.Task) error {
 	return mdb.Mysql.Create(t).Error
 }
@@ -39,20 +76,355 @@ func GetTaskByID(id uint) (*models.Task, error) {
 	return &t, nil
 }
 
-func ListTasksByUser(userID uint) ([]models.Task, error) {
+// CreateTaskWithChildren 在同一事务里创建播放列表父任务和子任务
+func CreateTaskWithChildren(parent *models.Task, children []*models.Task) error {
+	return mdb.Mysql.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(parent).Error; err != nil {
+			return err
+		}
+		for _, child := range children {
+			child.ParentID = parent.ID
+			if err := tx.Create(child).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListTasksByUser parentID 为 0 时只返回顶层任务
+func ListTasksByUser(userID uint, parentID uint) ([]models.Task, error) {
+	var out []models.Task
+	if err := mdb.Mysql.Where("user_id = ? AND parent_id = ?", userID, parentID).Order("created_at desc").Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func ListChildTasks(parentID uint) ([]models.Task, error) {
+	var out []models.Task
+	if err := mdb.Mysql.Where("parent_id = ?", parentID).Order("id asc").Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListTasksByStatus 按状态查询任务，用于节点重启后恢复队列
+func ListTasksByStatus(status models.TaskStatus) ([]models.Task, error) {
 	var out []models.Task
-	if err := mdb.Mysql.Where("user_id = ?", userID).Order("created_at desc").Find(&out).Error; err != nil {
+	if err := mdb.Mysql.Where("status = ?", status).Order("priority desc, id asc").Find(&out).Error; err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
+// ClaimTask 原子地把 pending 任务置为 running，多个节点同时认领时只有一个成功
+func ClaimTask(id uint) (bool, error) {
+	res := mdb.Mysql.Model(&models.Task{}).
+		Where("id = ? AND status = ?", id, models.StatusPending).
+		Updates(map[string]interface{}{"status": models.StatusRunning, "updated_at": time.Now()})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
 func UpdateTask(t *models.Task) error {
 	t.UpdatedAt = time.Now()
 	return mdb.Mysql.Save(t).Error
 }
 
-// Simple cache helper (JSON could be used). Example usage: caching video metadata (not used heavily here)
+// activeStatuses 可以取消、进度仍会变化的状态
+var activeStatuses = []models.TaskStatus{models.StatusPending, models.StatusRunning}
+
+// UpdateActiveTask 只在任务仍在等待或执行时写回整行，返回 false 表示已被取消或删除
+func UpdateActiveTask(t *models.Task) (bool, error) {
+	t.UpdatedAt = time.Now()
+	res := mdb.Mysql.Model(t).Where("status IN ?", activeStatuses).
+		Select("*").Omit("id", "created_at", "deleted_at").Updates(t)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return true, nil
+	}
+	// MySQL 对没有变化的行返回 0，再查一次状态确认
+	var status []models.TaskStatus
+	err := mdb.Mysql.Model(&models.Task{}).Where("id = ?", t.ID).Pluck("status", &status).Error
+	if err != nil {
+		return false, err
+	}
+	return len(status) == 1 && slices.Contains(activeStatuses, status[0]), nil
+}
+
+// UpdateParentTask 锁住父任务行后读取子任务，由 aggregate 修改父任务并返回要写入的列。
+// 多个子任务同时结束时依次汇总，不会用旧的快照覆盖新的结果；父任务已结束或被取消时不写，返回 nil
+func UpdateParentTask(parentID uint, aggregate func(parent *models.Task, children []models.Task) []string) (*models.Task, error) {
+	var updated *models.Task
+	err := mdb.Mysql.Transaction(func(tx *gorm.DB) error {
+		var parent models.Task
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND status IN ?", parentID, activeStatuses).First(&parent).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var children []models.Task
+		if err = tx.Where("parent_id = ?", parentID).Order("id asc").Find(&children).Error; err != nil {
+			return err
+		}
+		columns := aggregate(&parent, children)
+		if len(columns) == 0 {
+			return nil
+		}
+		parent.UpdatedAt = time.Now()
+		if err = tx.Model(&parent).Select(append(columns, "updated_at")).Updates(&parent).Error; err != nil {
+			return err
+		}
+		updated = &parent
+		return nil
+	})
+	return updated, err
+}
+
+// ReopenTask 重新开始已结束的任务，已在等待或执行时不变
+func ReopenTask(id uint) error {
+	return mdb.Mysql.Model(&models.Task{}).
+		Where("id = ? AND status NOT IN ?", id, activeStatuses).
+		Updates(map[string]interface{}{"status": models.StatusPending, "error_msg": "", "updated_at": time.Now()}).Error
+}
+
+// CancelTask 原子地取消处于 statuses 中的任务，默认为等待中或执行中；返回 false 表示任务已不在这些状态
+func CancelTask(id uint, statuses ...models.TaskStatus) (bool, error) {
+	if len(statuses) == 0 {
+		statuses = activeStatuses
+	}
+	res := mdb.Mysql.Model(&models.Task{}).
+		Where("id = ? AND status IN ?", id, statuses).
+		Updates(map[string]interface{}{
+			"status":     models.StatusCancelled,
+			"error_msg":  "",
+			"speed":      0,
+			"eta":        0,
+			"updated_at": time.Now(),
+		})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// DeleteTasks 软删除任务
+func DeleteTasks(ids []uint) error {
+	return mdb.Mysql.Delete(&models.Task{}, ids).Error
+}
+
+// CountTasksByFile 仍在使用某个存储 key 的任务数
+func CountTasksByFile(key string) (int64, error) {
+	var n int64
+	err := mdb.Mysql.Model(&models.Task{}).Where("file_path = ? OR processed_path = ?", key, key).Count(&n).Error
+	return n, err
+}
+
+func GetMediaCacheByKey(cacheKey string) (*models.MediaCache, error) {
+	var m models.MediaCache
+	if err := mdb.Mysql.Where("cache_key = ?", cacheKey).First(&m).Error; err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func CreateMediaCache(m *models.MediaCache) error {
+	return mdb.Mysql.Create(m).Error
+}
+
+// AcquireMediaCache 增加引用计数并刷新最近使用时间，缓存项已被淘汰时返回 false
+func AcquireMediaCache(id uint) (bool, error) {
+	res := mdb.Mysql.Model(&models.MediaCache{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"ref_count": gorm.Expr("ref_count + 1"), "last_used_at": time.Now()})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// ReleaseMediaCache 减少引用计数，不会小于 0
+func ReleaseMediaCache(id uint) error {
+	return mdb.Mysql.Model(&models.MediaCache{}).Where("id = ? AND ref_count > 0", id).
+		Update("ref_count", gorm.Expr("ref_count - 1")).Error
+}
+
+func DeleteMediaCache(id uint) error {
+	return mdb.Mysql.Delete(&models.MediaCache{}, id).Error
+}
+
+// MediaCacheTotalSize 缓存占用的总字节数
+func MediaCacheTotalSize() (int64, error) {
+	var total int64
+	err := mdb.Mysql.Model(&models.MediaCache{}).Select("COALESCE(SUM(size), 0)").Scan(&total).Error
+	return total, err
+}
+
+// ListUnreferencedMediaCache 没有任务引用的缓存项，最久未使用的在前
+func ListUnreferencedMediaCache(limit int) ([]models.MediaCache, error) {
+	var out []models.MediaCache
+	if err := mdb.Mysql.Where("ref_count = 0").Order("last_used_at asc").Limit(limit).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteUnreferencedMediaCache 只在引用计数仍为 0 时删除，避免与新任务竞争
+func DeleteUnreferencedMediaCache(id uint) (bool, error) {
+	res := mdb.Mysql.Where("id = ? AND ref_count = 0", id).Delete(&models.MediaCache{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// CountMediaCacheByFile 引用同一存储 key 的缓存项数（内容相同的不同格式）
+func CountMediaCacheByFile(key string) (int64, error) {
+	var n int64
+	err := mdb.Mysql.Model(&models.MediaCache{}).Where("file_path = ? OR processed_path = ?", key, key).Count(&n).Error
+	return n, err
+}
+
+// GetCredential 用户在某个域名的登录信息
+func GetCredential(userID uint, domain string) (*models.SiteCredential, error) {
+	var c models.SiteCredential
+	if err := mdb.Mysql.Where("user_id = ? AND domain = ?", userID, domain).First(&c).Error; err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func ListCredentials(userID uint) ([]models.SiteCredential, error) {
+	var out []models.SiteCredential
+	if err := mdb.Mysql.Where("user_id = ?", userID).Order("domain asc").Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SaveCredential 同一用户同一域名只保留一份，重新上传时覆盖
+func SaveCredential(c *models.SiteCredential) error {
+	return mdb.Mysql.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "domain"}},
+		DoUpdates: clause.AssignmentColumns([]string{"kind", "secret", "username", "cookie_count", "expires_at", "status", "last_error", "updated_at"}),
+	}).Create(c).Error
+}
+
+func DeleteCredential(userID uint, domain string) (bool, error) {
+	res := mdb.Mysql.Where("user_id = ? AND domain = ?", userID, domain).Delete(&models.SiteCredential{})
+	return res.RowsAffected > 0, res.Error
+}
+
+// UpdateCredentialStatus 记录站点是否还接受这份登录信息
+func UpdateCredentialStatus(id uint, status, lastError string) error {
+	return mdb.Mysql.Model(&models.SiteCredential{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"status": status, "last_error": lastError, "updated_at": time.Now()}).Error
+}
+
+func TouchCredential(id uint) error {
+	return mdb.Mysql.Model(&models.SiteCredential{}).Where("id = ?", id).Update("last_used_at", time.Now()).Error
+}
+
+func CreateSubscription(s *models.Subscription) error {
+	return mdb.Mysql.Create(s).Error
+}
+
+func GetSubscription(userID, id uint) (*models.Subscription, error) {
+	var s models.Subscription
+	if err := mdb.Mysql.Where("id = ? AND user_id = ?", id, userID).First(&s).Error; err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func ListSubscriptions(userID uint) ([]models.Subscription, error) {
+	var out []models.Subscription
+	if err := mdb.Mysql.Where("user_id = ?", userID).Order("id desc").Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdateSubscription 只写用户修改的列，不覆盖同时进行的拉取写入的时间和错误
+func UpdateSubscription(userID, id uint, updates map[string]interface{}) error {
+	updates["updated_at"] = time.Now()
+	return mdb.Mysql.Model(&models.Subscription{}).Where("id = ? AND user_id = ?", id, userID).Updates(updates).Error
+}
+
+// DeleteSubscription 同时删除见过的作品记录，已创建的任务保留
+func DeleteSubscription(userID, id uint) (bool, error) {
+	var deleted bool
+	err := mdb.Mysql.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND user_id = ?", id, userID).Delete(&models.Subscription{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		deleted = true
+		return tx.Where("subscription_id = ?", id).Delete(&models.SubscriptionEntry{}).Error
+	})
+	return deleted, err
+}
+
+// ListDueSubscriptions 到了拉取时间的订阅
+func ListDueSubscriptions(now time.Time, limit int) ([]models.Subscription, error) {
+	var out []models.Subscription
+	err := mdb.Mysql.Where("enabled = ? AND next_poll_at <= ?", true, now).
+		Order("next_poll_at asc").Limit(limit).Find(&out).Error
+	return out, err
+}
+
+// ClaimSubscription 把到期订阅的下次拉取时间推后，多个节点同时认领时只有一个成功
+func ClaimSubscription(id uint, now, next time.Time) (bool, error) {
+	res := mdb.Mysql.Model(&models.Subscription{}).
+		Where("id = ? AND enabled = ? AND next_poll_at <= ?", id, true, now).
+		Updates(map[string]interface{}{"next_poll_at": next, "updated_at": time.Now()})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// FinishSubscriptionPoll 记录拉取时间和错误，不覆盖期间用户修改的设置
+func FinishSubscriptionPoll(id uint, title, lastError string) error {
+	updates := map[string]interface{}{"last_polled_at": time.Now(), "last_error": lastError, "updated_at": time.Now()}
+	if title != "" {
+		updates["title"] = title
+	}
+	return mdb.Mysql.Model(&models.Subscription{}).Where("id = ?", id).Updates(updates).Error
+}
+
+// SeenSubscriptionVideos videoIDs 中已经处理过的
+func SeenSubscriptionVideos(subscriptionID uint, videoIDs []string) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	if len(videoIDs) == 0 {
+		return seen, nil
+	}
+	var ids []string
+	err := mdb.Mysql.Model(&models.SubscriptionEntry{}).
+		Where("subscription_id = ? AND video_id IN ?", subscriptionID, videoIDs).
+		Pluck("video_id", &ids).Error
+	for _, id := range ids {
+		seen[id] = true
+	}
+	return seen, err
+}
+
+// AddSubscriptionEntries 记录见过的作品，已存在的忽略
+func AddSubscriptionEntries(entries []models.SubscriptionEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return mdb.Mysql.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(entries, 200).Error
+}
+
+// Simple cache helpers, used for caching parse results
 func CacheSet(ctx context.Context, key string, val string, ttl time.Duration) error {
 	return mdb.Redis.Set(ctx, key, val, ttl).Err()
 }
@@ -60,3 +432,202 @@ func CacheSet(ctx context.Context, key string, val string, ttl time.Duration) er
 func CacheGet(ctx context.Context, key string) (string, error) {
 	return mdb.Redis.Get(ctx, key).Result()
 }
+
+// CacheDeletePrefix 按前缀删除，用 SCAN 分批避免阻塞 Redis
+func CacheDeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	var deleted int64
+	iter := mdb.Redis.Scan(ctx, 0, prefix+"*", 500).Iterator()
+	batch := make([]string, 0, 500)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		n, err := mdb.Redis.Del(ctx, batch...).Result()
+		deleted += n
+		batch = batch[:0]
+		return err
+	}
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == cap(batch) {
+			if err := flush(); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return deleted, err
+	}
+	return deleted, flush()
+}
+
+// 封面镜像索引：有序集合记录最近一次使用时间，另存原始地址以便重新抓取
+const (
+	coverIndexKey  = "covers:index"
+	coverSourceKey = "covers:src:"
+)
+
+// TouchCover 记录封面的原始地址并刷新使用时间
+func TouchCover(ctx context.Context, key, src string) error {
+	pipe := mdb.Redis.TxPipeline()
+	pipe.ZAdd(ctx, coverIndexKey, redis.Z{Score: float64(time.Now().Unix()), Member: key})
+	pipe.Set(ctx, coverSourceKey+key, src, 0)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func GetCoverSource(ctx context.Context, key string) (string, error) {
+	return mdb.Redis.Get(ctx, coverSourceKey+key).Result()
+}
+
+// ListStaleCovers before 之前没有再使用过的封面
+func ListStaleCovers(ctx context.Context, before time.Time, limit int64) ([]string, error) {
+	return mdb.Redis.ZRangeByScore(ctx, coverIndexKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(before.Unix(), 10),
+		Count: limit,
+	}).Result()
+}
+
+// RemoveStaleCover 期间没有被再次使用时移除索引，返回是否移除
+func RemoveStaleCover(ctx context.Context, key string, before time.Time) (bool, error) {
+	score, err := mdb.Redis.ZScore(ctx, coverIndexKey, key).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return false, err
+	}
+	if err == nil && score > float64(before.Unix()) {
+		return false, nil
+	}
+	pipe := mdb.Redis.TxPipeline()
+	pipe.ZRem(ctx, coverIndexKey, key)
+	pipe.Del(ctx, coverSourceKey+key)
+	_, err = pipe.Exec(ctx)
+	return err == nil, err
+}
+
+// 套餐额度计数：Lua 脚本保证检查和累加是原子的
+var quotaConsumeScript = redis.NewScript(`
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+local n = tonumber(ARGV[1])
+if used + n > tonumber(ARGV[2]) then
+	return {0, used}
+end
+used = redis.call('INCRBY', KEYS[1], n)
+redis.call('EXPIREAT', KEYS[1], ARGV[3])
+return {1, used}
+`)
+
+// 并发名额：有序集合的 score 是租约到期时间，进程异常退出时名额自动过期。
+// 多个节点推流同一任务时共用一个 member，引用计数在 KEYS[2] 中，全部释放后才归还名额
+var quotaSlotScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[3])
+for _, m in ipairs(expired) do
+	redis.call('HDEL', KEYS[2], m)
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[3])
+local n = redis.call('ZCARD', KEYS[1])
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	redis.call('HINCRBY', KEYS[2], ARGV[1], 1)
+elseif n >= tonumber(ARGV[2]) then
+	return {0, n}
+else
+	redis.call('HSET', KEYS[2], ARGV[1], 1)
+end
+redis.call('ZADD', KEYS[1], ARGV[4], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+redis.call('PEXPIRE', KEYS[2], ARGV[5])
+return {1, redis.call('ZCARD', KEYS[1])}
+`)
+
+var quotaReleaseScript = redis.NewScript(`
+if redis.call('HINCRBY', KEYS[2], ARGV[1], -1) <= 0 then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	redis.call('ZREM', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+func quotaSlotRefsKey(key string) string {
+	return key + ":refs"
+}
+
+// 任务的流量：KEYS[2] 记录该任务已计入的字节数，只累计超出的部分，同一任务的推流和下载不重复计
+var quotaTaskBytesScript = redis.NewScript(`
+local counted = tonumber(redis.call('GET', KEYS[2]) or '0')
+local n = tonumber(ARGV[1])
+if n <= counted then
+	return 0
+end
+redis.call('SET', KEYS[2], n)
+redis.call('EXPIREAT', KEYS[2], ARGV[2])
+redis.call('INCRBY', KEYS[1], n - counted)
+redis.call('EXPIREAT', KEYS[1], ARGV[2])
+return n - counted
+`)
+
+// QuotaConsume 计数加 n，超过 limit 时不加；返回是否成功和当前用量
+func QuotaConsume(ctx context.Context, key string, n, limit int64, expireAt time.Time) (bool, int64, error) {
+	return quotaResult(quotaConsumeScript.Run(ctx, mdb.Redis, []string{key}, n, limit, expireAt.Unix()).Int64Slice())
+}
+
+// QuotaAdd 无条件累加，n 为负数时用于退还
+func QuotaAdd(ctx context.Context, key string, n int64, expireAt time.Time) (int64, error) {
+	pipe := mdb.Redis.TxPipeline()
+	incr := pipe.IncrBy(ctx, key, n)
+	pipe.ExpireAt(ctx, key, expireAt)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// QuotaAddTaskBytes 任务下载了 n 字节，返回实际计入 key 的字节数
+func QuotaAddTaskBytes(ctx context.Context, key, taskKey string, n int64, expireAt time.Time) (int64, error) {
+	return quotaTaskBytesScript.Run(ctx, mdb.Redis, []string{key, taskKey}, n, expireAt.Unix()).Int64()
+}
+
+func QuotaGet(ctx context.Context, key string) (int64, error) {
+	n, err := mdb.Redis.Get(ctx, key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// QuotaAcquireSlot 占用一个并发名额，member 已占用时共用同一个名额并增加引用
+func QuotaAcquireSlot(ctx context.Context, key, member string, limit int64, lease time.Duration) (bool, int64, error) {
+	now := time.Now()
+	return quotaResult(quotaSlotScript.Run(ctx, mdb.Redis, []string{key, quotaSlotRefsKey(key)}, member, limit,
+		now.UnixMilli(), now.Add(lease).UnixMilli(), lease.Milliseconds()).Int64Slice())
+}
+
+// QuotaRefreshSlot 续约仍在使用的名额
+func QuotaRefreshSlot(ctx context.Context, key, member string, lease time.Duration) error {
+	pipe := mdb.Redis.TxPipeline()
+	pipe.ZAddXX(ctx, key, redis.Z{Score: float64(time.Now().Add(lease).UnixMilli()), Member: member})
+	pipe.PExpire(ctx, key, lease)
+	pipe.PExpire(ctx, quotaSlotRefsKey(key), lease)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// QuotaReleaseSlot 减少引用，最后一个使用者释放时归还名额
+func QuotaReleaseSlot(ctx context.Context, key, member string) error {
+	return quotaReleaseScript.Run(ctx, mdb.Redis, []string{key, quotaSlotRefsKey(key)}, member).Err()
+}
+
+// QuotaSlots 未过期的名额数
+func QuotaSlots(ctx context.Context, key string) (int64, error) {
+	return mdb.Redis.ZCount(ctx, key, strconv.FormatInt(time.Now().UnixMilli(), 10), "+inf").Result()
+}
+
+func quotaResult(vals []int64, err error) (bool, int64, error) {
+	if err != nil {
+		return false, 0, err
+	}
+	if len(vals) != 2 {
+		return false, 0, fmt.Errorf("unexpected quota script result %v", vals)
+	}
+	return vals[0] == 1, vals[1], nil
+}
+
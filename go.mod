@@ -14,6 +14,7 @@ require (
 	github.com/spf13/cobra v1.10.2
 	github.com/valyala/fasthttp v1.68.0
 	golang.org/x/crypto v0.43.0
+	golang.org/x/sync v0.17.0
 	gorm.io/driver/mysql v1.5.0
 	gorm.io/gorm v1.26.0
 )
@@ -87,7 +87,7 @@ func New(strLevel, format string, pathname string, flag int, outWriter ...io.Wri
 	case "FATAL":
 		level = fatalLevel
 	default:
-		errors.New("unknown level: " + strLevel)
+		return errors.New("unknown level: " + strLevel)
 	}
 	once.Do(func() {
 		// logger
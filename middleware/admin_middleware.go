@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"minodl/config"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const keyAdminToken = "X-Admin-Token"
+
+// AdminMiddleware 管理接口校验 X-Admin-Token，未配置 admin_token 时一律拒绝
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := config.Get().AdminToken
+		if token == empty {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin api disabled"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader(keyAdminToken)), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
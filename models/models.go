@@ -11,11 +11,19 @@ type User struct {
 	ID        uint   `gorm:"primaryKey"`
 	Email     string `gorm:"uniqueIndex;size:255;not null"`
 	Password  string `gorm:"size:255;not null"` // note: store bcrypt hash
+	Plan      string `gorm:"size:32;default:FREE"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
+// 用户套餐，决定下载队列优先级
+const (
+	PlanFree  = "FREE"
+	PlanPro   = "PRO"
+	PlanUltra = "ULTRA"
+)
+
 type TaskStatus string
 
 const (
@@ -23,23 +31,128 @@ const (
 	StatusRunning   TaskStatus = "running"
 	StatusCompleted TaskStatus = "completed"
 	StatusFailed    TaskStatus = "failed"
+	StatusCancelled TaskStatus = "cancelled"
 )
 
 type Task struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	UserID    uint           `gorm:"index" json:"user_id"`
-	Title     string         `gorm:"size:255" json:"title"`
-	SourceURL string         `gorm:"size:1024" json:"source_url"` // original share link
-	VideoURL  string         `gorm:"size:1024" json:"video_url"`  // resolved direct video URL or storage path (TODO)
-	Status    TaskStatus     `gorm:"size:32;index" json:"status"`
-	Progress  string         `json:"progress"`
-	FilePath  string         `gorm:"size:1024" json:"file_path"` // local storage path when downloaded
-	ErrorMsg  string         `gorm:"size:1024" json:"error_msg"`
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"index" json:"user_id"`
+	Title       string     `gorm:"size:255" json:"title"`
+	SourceURL   string     `gorm:"size:1024" json:"source_url"` // original share link
+	VideoURL    string     `gorm:"size:1024" json:"video_url"`  // resolved direct video URL or storage path (TODO)
+	Status      TaskStatus `gorm:"size:32;index" json:"status"`
+	Progress    float64    `json:"progress"`                   // percent of the download stage
+	FilePath    string     `gorm:"size:1024" json:"file_path"` // local storage path when downloaded
+	ErrorMsg    string     `gorm:"size:1024" json:"error_msg"`
+	ErrorCode   string     `gorm:"size:32" json:"error_code"` // machine-readable failure reason
+	Attempts    int        `json:"attempts"`
+	NextRetryAt *time.Time `json:"next_retry_at"`         // set while waiting for an automatic retry
+	Priority    int        `json:"priority"`              // queue priority, derived from the owner's plan
+	Format      string     `gorm:"size:64" json:"format"` // chosen format_id or quality label
+	FormatSpec  string     `gorm:"size:255" json:"-"`     // resolved yt-dlp -f selector
+	Duration    int        `json:"duration"`              // seconds, from the parse result
+	// structured progress reported by yt-dlp's --progress-template
+	Stage           string  `gorm:"size:16" json:"stage"` // download | merge | postprocess
+	DownloadedBytes int64   `json:"downloaded_bytes"`
+	TotalBytes      int64   `json:"total_bytes"` // 0 when unknown
+	Speed           float64 `json:"speed"`       // bytes per second
+	ETA             int     `json:"eta"`         // seconds, 0 when unknown
+	// post-processing (ffmpeg) stage, only for background downloads
+	Profile         string     `gorm:"size:32" json:"profile"`
+	ProfileStatus   TaskStatus `gorm:"size:32" json:"profile_status"`
+	ProfileProgress float64    `json:"profile_progress"`
+	ProcessedPath   string     `gorm:"size:1024" json:"processed_path"` // storage key of the processed output
+	// subtitles: sidecar files, or embedded / burned into the video
+	SubLangs      string   `gorm:"size:255" json:"sub_langs"`                       // comma separated language codes
+	SubAuto       bool     `json:"sub_auto"`                                        // allow auto-generated captions
+	SubFormat     string   `gorm:"size:8" json:"sub_format"`                        // srt | vtt
+	SubMode       string   `gorm:"size:8" json:"sub_mode"`                          // "" sidecar | embed | burn
+	SubtitlePaths []string `gorm:"type:text;serializer:json" json:"subtitle_paths"` // storage keys of the sidecar files
+	// playlist / channel / multi-part: the parent only aggregates its children
+	ParentID   uint `gorm:"index" json:"parent_id"`
+	ChildCount int  `json:"child_count"`
+	// scheduling: off-peak downloads and tasks created by subscriptions
+	NotBefore      *time.Time `json:"not_before"`                   // not queued before this time
+	SubscriptionID uint       `gorm:"index" json:"subscription_id"` // 0 when created by the user
+	// media cache: tasks for the same content share one stored file
+	CacheKey  string         `gorm:"size:64;index" json:"-"`
+	CacheID   uint           `gorm:"index" json:"cache_id"`
+	Cached    bool           `json:"cached"` // completed from the cache without downloading
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
+// MediaCache 已下载的媒体，按来源视频 + 格式 + 后处理去重，多个任务共享同一份文件
+type MediaCache struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	CacheKey      string    `gorm:"uniqueIndex;size:64;not null" json:"cache_key"` // sha256(extractor|video id|format|profile)
+	SourceURL     string    `gorm:"size:1024" json:"source_url"`                   // normalized
+	FormatSpec    string    `gorm:"size:255" json:"format_spec"`
+	Profile       string    `gorm:"size:32" json:"profile"`
+	FilePath      string    `gorm:"size:1024" json:"file_path"` // content-addressed storage key
+	ProcessedPath string    `gorm:"size:1024" json:"processed_path"`
+	SubtitlePaths []string  `gorm:"type:text;serializer:json" json:"subtitle_paths"`
+	SHA256        string    `gorm:"size:64;index" json:"sha256"` // checksum of the original file
+	Size          int64     `json:"size"`                        // bytes of the original and processed files
+	RefCount      int       `gorm:"index" json:"ref_count"`      // live tasks referencing this entry
+	LastUsedAt    time.Time `gorm:"index" json:"last_used_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// SiteCredential 用户在某个站点的 cookie 或账号密码，解析和下载该用户的任务时使用
+type SiteCredential struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"uniqueIndex:idx_user_domain;not null" json:"user_id"`
+	Domain      string     `gorm:"uniqueIndex:idx_user_domain;size:255;not null" json:"domain"` // e.g. youtube.com, subdomains included
+	Kind        string     `gorm:"size:16" json:"kind"`                                         // cookies | password
+	Secret      string     `gorm:"type:text" json:"-"`                                          // AES-GCM encrypted cookie file or credentials
+	Username    string     `gorm:"size:255" json:"username"`                                    // shown to the owner, password kind only
+	CookieCount int        `json:"cookie_count"`
+	ExpiresAt   *time.Time `json:"expires_at"`                  // earliest expiry of the login cookies, nil when unknown
+	Status      string     `gorm:"size:16" json:"status"`       // valid | expired
+	LastError   string     `gorm:"size:1024" json:"last_error"` // why the site rejected it
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+const (
+	CredentialCookies  = "cookies"
+	CredentialPassword = "password"
+
+	CredentialValid   = "valid"
+	CredentialExpired = "expired"
+)
+
+// Subscription 关注的频道或播放列表，定时拉取新作品并创建下载任务
+type Subscription struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	UserID       uint       `gorm:"index;not null" json:"user_id"`
+	SourceURL    string     `gorm:"size:1024" json:"source_url"` // canonical channel or playlist URL
+	Title        string     `gorm:"size:255" json:"title"`
+	PollInterval int        `json:"poll_interval"`           // seconds
+	Keyword      string     `gorm:"size:255" json:"keyword"` // title must contain it, case-insensitive
+	MaxDuration  int        `json:"max_duration"`            // seconds, 0 for no limit
+	Format       string     `gorm:"size:64" json:"format"`   // quality label for created tasks
+	Enabled      bool       `gorm:"default:true" json:"enabled"`
+	NextPollAt   time.Time  `gorm:"index" json:"next_poll_at"`
+	LastPolledAt *time.Time `json:"last_polled_at"`
+	LastError    string     `gorm:"size:1024" json:"last_error"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// SubscriptionEntry 订阅见过的作品，同一作品只处理一次
+type SubscriptionEntry struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	SubscriptionID uint      `gorm:"uniqueIndex:idx_sub_video;not null" json:"subscription_id"`
+	VideoID        string    `gorm:"uniqueIndex:idx_sub_video;size:255;not null" json:"video_id"`
+	TaskID         uint      `json:"task_id"` // 0 when filtered out or seen on the first poll
+	CreatedAt      time.Time `json:"created_at"`
+}
+
 type Claims struct {
 	UserID uint `json:"user_id"`
 	jwt.RegisteredClaims
@@ -2,28 +2,92 @@ package models
 
 // VideoFormat 定义视频格式的结构体
 type VideoFormat struct {
-	ID     string `json:"format_id"`
-	Ext    string `json:"video_ext"`
-	Format string `json:"format"`
-	Height int    `json:"height"`
-	URL    string `json:"url"`
-	Size   int    `json:"filesize"`
+	ID         string  `json:"format_id"`
+	Ext        string  `json:"ext"`
+	VideoExt   string  `json:"video_ext"`
+	Format     string  `json:"format"`
+	FormatNote string  `json:"format_note"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	FPS        float64 `json:"fps"`
+	VCodec     string  `json:"vcodec"`
+	ACodec     string  `json:"acodec"`
+	ABR        float64 `json:"abr"`
+	TBR        float64 `json:"tbr"`
+	Protocol   string  `json:"protocol"`
+	URL        string  `json:"url"`
+	Size       int64   `json:"filesize"`
+	SizeApprox float64 `json:"filesize_approx"`
+}
+
+// SubtitleFormat yt-dlp subtitles / automatic_captions 中的一种格式
+type SubtitleFormat struct {
+	Ext  string `json:"ext"`
+	URL  string `json:"url"`
+	Name string `json:"name"`
+}
+
+// Subtitle 某种语言可下载的字幕
+type Subtitle struct {
+	Lang    string   `json:"lang"`
+	Name    string   `json:"name"`
+	Auto    bool     `json:"auto"`    // 自动生成的字幕
+	Formats []string `json:"formats"` // 源格式，下载时统一转换为 srt 或 vtt
+}
+
+// PlaylistEntry 播放列表、频道或分P视频中的一项
+type PlaylistEntry struct {
+	Index    int     `json:"index"` // 从 1 开始
+	ID       string  `json:"id"`
+	IEKey    string  `json:"ie_key"` // 条目所属的 extractor
+	Title    string  `json:"title"`
+	URL      string  `json:"url"`
+	Duration float64 `json:"duration"`
 }
 
 // VideoInfo 定义视频信息的结构体
 type VideoInfo struct {
-	Title     string        `json:"title"`
-	Formats   []VideoFormat `json:"formats"`
-	URL       string        `json:"webpage_url"`
-	PlayUrl   string        `json:"play_url"`
-	Duration  float64       `json:"duration"`
-	Thumbnail string        `json:"thumbnail"` // 新增封面URL字段
+	Type      string          `json:"_type"` // playlist 表示多条目
+	ID        string          `json:"id"`
+	Extractor string          `json:"extractor_key"`
+	Entries   []PlaylistEntry `json:"entries"`
+	Title     string          `json:"title"`
+	Formats   []VideoFormat   `json:"formats"`
+	URL       string          `json:"webpage_url"`
+	PlayUrl   string          `json:"play_url"`
+	Duration  float64         `json:"duration"`
+	Thumbnail string          `json:"thumbnail"` // 新增封面URL字段
+	// 语言 -> 可用格式
+	Subtitles    map[string][]SubtitleFormat `json:"subtitles"`
+	AutoCaptions map[string][]SubtitleFormat `json:"automatic_captions"`
+	// 图集作品的图片地址，只有原生解析会填写
+	Images []string `json:"-"`
+}
+
+// Quality 可供用户选择的清晰度/格式
+type Quality struct {
+	FormatID   string `json:"format_id"`
+	Label      string `json:"label"` // 1080p、720p60、audio m4a 等
+	Resolution string `json:"resolution"`
+	Height     int    `json:"height"`
+	Ext        string `json:"ext"` // 容器格式
+	VCodec     string `json:"vcodec"`
+	ACodec     string `json:"acodec"`
+	Size       int64  `json:"size"` // 预估大小，字节，0 表示未知
+	AudioOnly  bool   `json:"audio_only"`
 }
 
 type VideoResult struct {
-	Title     string              `json:"title"`
-	Duration  int                 `json:"duration"`
-	Thumbnail string              `json:"thumbnail"`
-	Qualities []map[string]string `json:"qualities"`
-	Ad        string              `json:"ad"`
+	IsPlaylist bool            `json:"is_playlist"`
+	URL        string          `json:"url"` // canonical link, use it when creating tasks
+	Extractor  string          `json:"extractor"`
+	VideoID    string          `json:"video_id"`
+	Entries    []PlaylistEntry `json:"entries,omitempty"`
+	Title      string          `json:"title"`
+	Duration   int             `json:"duration"`
+	Thumbnail  string          `json:"thumbnail"`
+	Qualities  []Quality       `json:"qualities"`
+	Subtitles  []Subtitle      `json:"subtitles"`
+	Images     []string        `json:"images,omitempty"` // 图集作品，下载结果为 zip
+	Ad         string          `json:"ad"`
 }
@@ -16,17 +16,50 @@ func DownloadApi() *gin.Engine {
 	router.GET("/policy/terms", controller.GetTerms)
 	router.POST("/auth/register", controller.Register)
 	router.POST("/auth/login", controller.Login)
+	// supported domains and their capabilities, generated from extractor routing
+	router.GET("/sites", controller.ListSites)
+	// mirrored covers, loaded by the app without auth headers
+	router.GET("/statics/covers/:name", controller.GetThumbnail)
+	// signed links for players and download managers that can't send auth headers
+	router.GET("/s/tasks/:id/stream", controller.SignedStream)
+	router.GET("/s/tasks/:id/download", controller.SignedDownload)
+	router.GET("/s/tasks/:id/hls/:kind/:file", controller.SignedHLS)
 
 	// protected
 	auth := router.Group("/api", middleware.RequestAuthMiddleware())
 	{
 		auth.GET("/me", controller.GetProfile)
+		auth.POST("/parse", controller.ParseVideo)
+		auth.GET("/profiles", controller.ListProfiles)
 		auth.POST("/tasks", controller.CreateTask)
+		auth.POST("/tasks/batch", controller.CreateTasksBatch)
 		auth.GET("/tasks", controller.ListTasks)
+		auth.GET("/tasks/events", controller.UserEvents) // SSE feed of all the user's tasks
 		auth.GET("/tasks/:id", controller.GetTask)
-		auth.POST("/tasks/:id/complete", controller.MarkTaskComplete) // used when server-side download finishes
-		auth.POST("/tasks/:id/start", controller.StartTask)           // kick off mock download job
+		auth.DELETE("/tasks/:id", controller.DeleteTask)    // releases the shared media cache entry
+		auth.POST("/tasks/:id/start", controller.StartTask) // (re)queue a background download
+		auth.POST("/tasks/:id/cancel", controller.CancelTask)
+		auth.POST("/tasks/:id/retry", controller.RetryTask)
 		auth.GET("/tasks/:id/stream", controller.StreamTask)
+		auth.GET("/tasks/:id/events", controller.TaskEvents)
+		auth.GET("/tasks/:id/hls/:kind/:file", controller.TaskHLS) // kind: fmp4 | ts, file: index.m3u8 and segments
+		auth.GET("/tasks/:id/download", controller.DownloadTask) // completed file, supports Range
+		auth.GET("/tasks/:id/sign", controller.SignTask)
+		auth.GET("/tasks/:id/subtitles/:lang", controller.TaskSubtitle)
+		// per-site cookies or credentials used for this user's parses and downloads
+		auth.GET("/credentials", controller.ListCredentials)
+		auth.PUT("/credentials/:domain", controller.SaveCredential)
+		auth.DELETE("/credentials/:domain", controller.DeleteCredential)
+		// channel / playlist subscriptions, polled for new uploads
+		auth.GET("/subscriptions", controller.ListSubscriptions)
+		auth.POST("/subscriptions", controller.CreateSubscription)
+		auth.PATCH("/subscriptions/:id", controller.UpdateSubscription)
+		auth.DELETE("/subscriptions/:id", controller.DeleteSubscription)
+	}
+	// admin, X-Admin-Token
+	admin := router.Group("/admin", middleware.AdminMiddleware())
+	{
+		admin.DELETE("/parse-cache", controller.InvalidateParseCache) // ?url=... or ?all=1
 	}
 	return router
 }
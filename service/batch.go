@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"minodl/models"
+	"minodl/utils"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxBatchURLs = 20
+	batchWorkers = 4
+
+	ErrCodeInvalidURL = "invalid_url"
+	ErrCodeDuplicate  = "duplicate"
+)
+
+// TaskError 结构化错误，客户端按 code 展示提示
+type TaskError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// BatchItem 批量创建中单个链接的结果，Task 和 Error 二选一
+type BatchItem struct {
+	URL   string       `json:"url"`
+	Task  *models.Task `json:"task,omitempty"`
+	Error *TaskError   `json:"error,omitempty"`
+}
+
+// CreateTasksBatch 并发解析多个链接，单个链接失败不影响其它链接
+func CreateTasksBatch(userID uint, urls []string, opts TaskOptions) ([]BatchItem, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("urls is empty")
+	}
+	if len(urls) > MaxBatchURLs {
+		return nil, fmt.Errorf("at most %d urls per batch", MaxBatchURLs)
+	}
+	if opts.NotBefore != nil && time.Until(*opts.NotBefore) > maxScheduleAhead {
+		return nil, ErrScheduleTooFar
+	}
+	items := make([]BatchItem, len(urls))
+	links := make([]string, len(urls))
+	var pending []int
+	for i, raw := range urls {
+		items[i].URL = strings.TrimSpace(raw)
+		// 可以是分享文案，取出其中的链接
+		link, ok := extractShareURL(items[i].URL)
+		if !ok || !validURL(link) {
+			items[i].Error = &TaskError{Code: ErrCodeInvalidURL, Message: "not a valid http(s) url"}
+			continue
+		}
+		links[i] = link
+		pending = append(pending, i)
+	}
+	// 短链跟随跳转后再去重，同一作品的不同分享链接只创建一次
+	runBatch(items, pending, func(i int) {
+		resolved, err := ResolveShareURL(context.Background(), links[i])
+		if err != nil {
+			items[i].Error = batchError(err)
+			return
+		}
+		links[i] = resolved
+	})
+	seen := make(map[string]bool, len(urls))
+	unique := pending[:0]
+	for _, i := range pending {
+		if items[i].Error != nil {
+			continue
+		}
+		key := normalizeSourceURL(links[i])
+		if seen[key] {
+			items[i].Error = &TaskError{Code: ErrCodeDuplicate, Message: "duplicate url in batch"}
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, i)
+	}
+	runBatch(items, unique, func(i int) {
+		t, err := CreateTaskForUser(userID, links[i], opts)
+		if err != nil {
+			items[i].Error = batchError(err)
+			return
+		}
+		items[i].Task = t
+	})
+	return items, nil
+}
+
+// runBatch 由 batchWorkers 个协程处理指定条目，单个条目 panic 时记为失败，不影响其它条目
+func runBatch(items []BatchItem, indexes []int, fn func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < batchWorkers && w < len(indexes); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				finished := false
+				utils.SafeCall(func() {
+					fn(i)
+					finished = true
+				})
+				if !finished {
+					items[i].Error = &TaskError{Code: FailUnknown, Message: "internal error"}
+				}
+			}
+		}()
+	}
+	for _, i := range indexes {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func batchError(err error) *TaskError {
+	var qe *QuotaError
+	if errors.As(err, &qe) {
+		return &TaskError{Code: FailQuota, Message: err.Error()}
+	}
+	return &TaskError{Code: ClassifyFailure(err.Error(), err), Message: err.Error()}
+}
+
+func validURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const streamBufferSize = 16 << 20 // 每个推流保留的最近数据
+
+// 最后一个观众离开后保留推流的时间，测试中缩短
+var streamIdleGrace = 5 * time.Second
+
+var (
+	// ErrStreamLagged 观众读取太慢，需要的数据已被环形缓冲覆盖
+	ErrStreamLagged = errors.New("stream subscriber lagged behind")
+	// ErrStreamStarted 推流的开头已被环形缓冲覆盖，新观众拿不到文件头，只能等下载完成
+	ErrStreamStarted = errors.New("stream is past its beginning, wait for the download to finish")
+)
+
+// 本节点正在推流的任务，task_id -> *Broadcast
+var streams = struct {
+	sync.Mutex
+	m map[uint]*Broadcast
+}{m: make(map[uint]*Broadcast)}
+
+// Broadcast 一次下载的输出写入环形缓冲，同一任务的多个观众共享
+type Broadcast struct {
+	taskID uint
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	start  int64 // 缓冲中最早字节的绝对偏移
+	end    int64 // 已写入的总字节数
+	subs   int
+	idle   *time.Timer
+	done   bool
+	err    error
+	cancel context.CancelCauseFunc // 终止下载
+	closed bool                    // 因无人观看而停止，不再接受新观众
+	// 最后离开的是直接观看的客户端，空闲停止后取消队列还没开始的任务
+	cancelTask bool
+}
+
+// JoinStream 客户端直接观看任务的推流，本节点没有可用的推流时启动下载。
+// 推流只是实时观看，不修改任务的进度，任务仍由下载队列负责。只有推流在下载的任务，
+// 即队列还没开始的任务，在最后一个直接观看的客户端断开后取消
+func JoinStream(t *models.Task) (*StreamReader, error) {
+	return joinStream(t, true)
+}
+
+// joinStream cancelTask 为 false 的观众（HLS 切片）离开时不会取消任务
+func joinStream(t *models.Task, cancelTask bool) (*StreamReader, error) {
+	streams.Lock()
+	b, ok := streams.m[t.ID]
+	streams.Unlock()
+	if ok {
+		if r, err := b.subscribe(); r != nil || err != nil {
+			if r != nil {
+				r.cancelTask = cancelTask
+			}
+			return r, err
+		}
+	}
+	if len(ExtractorsFor(t.SourceURL)) == 0 {
+		return nil, ErrNoExtractor
+	}
+	// 只有启动新的下载才占用并发名额，加入已有推流不占。推流是独立的 yt-dlp 进程，
+	// 队列正在下载同一任务时也另占一个名额。访问 Redis 时不持有全局锁
+	release, err := acquireDownloadSlot(t.UserID, "stream:"+strconv.FormatUint(uint64(t.ID), 10))
+	if err != nil {
+		return nil, err
+	}
+	streams.Lock()
+	if b, ok = streams.m[t.ID]; ok {
+		// 占用名额期间其他观众已经启动了推流
+		r, err := b.subscribe()
+		if r != nil || err != nil {
+			streams.Unlock()
+			release()
+			if r != nil {
+				r.cancelTask = cancelTask
+			}
+			return r, err
+		}
+	}
+	b = &Broadcast{
+		taskID: t.ID,
+		buf:    make([]byte, streamBufferSize),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	// 先加入第一个观众，下载立即失败时也能读到错误
+	r, _ := b.subscribe()
+	r.cancelTask = cancelTask
+	streams.m[t.ID] = b
+	streams.Unlock()
+	b.run(t, release)
+	return r, nil
+}
+
+// run 后台下载写入缓冲，客户端全部断开或任务被取消时终止，结束后释放并发名额并累计流量。
+// 使用任务的副本和独立的上下文，不登记为任务进程，取消推流不会影响队列中的下载
+func (b *Broadcast) run(t *models.Task, release func()) {
+	tracker := newStreamTracker(t)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	b.mu.Lock()
+	b.cancel = cancel
+	b.mu.Unlock()
+	go func() {
+		defer cancel(nil)
+		defer release()
+		defer func() {
+			b.mu.Lock()
+			n := b.end
+			b.mu.Unlock()
+			addBytesUsage(t.UserID, t.ID, n)
+		}()
+		auth, err := siteAuthFor(t.UserID, t.SourceURL)
+		if err != nil {
+			b.finish(err)
+			return
+		}
+		defer auth.Close()
+		tracker.auth = auth
+		_, err = downloadVideo(ctx, DownloadRequest{
+			URL:        t.SourceURL,
+			FormatSpec: StreamFormatSpec(t.FormatSpec),
+			Writer:     b,
+			Tracker:    tracker,
+			Auth:       auth,
+		})
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			err = context.Cause(ctx)
+		default:
+			// 只取 yt-dlp 输出的错误信息，登录信息失效时仍然标记
+			err = tracker.classify(err)
+		}
+		b.finish(err)
+	}()
+}
+
+// stopStream 任务被取消时停止本节点上的推流
+func stopStream(taskID uint) {
+	streams.Lock()
+	b := streams.m[taskID]
+	streams.Unlock()
+	if b != nil {
+		b.stop(ErrTaskCancelled)
+	}
+}
+
+// stop 终止下载，不再接受新观众
+func (b *Broadcast) stop(cause error) {
+	b.mu.Lock()
+	b.closed = true
+	cancel := b.cancel
+	b.mu.Unlock()
+	if cancel != nil {
+		cancel(cause)
+	}
+}
+
+// Write 写入环形缓冲，覆盖最旧的数据
+func (b *Broadcast) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	size := int64(len(b.buf))
+	for written := 0; written < len(p); {
+		n := copy(b.buf[b.end%size:], p[written:])
+		b.end += int64(n)
+		written += n
+	}
+	if b.end-b.start > size {
+		b.start = b.end - size
+	}
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// finish 下载结束，已缓冲的数据仍可读完
+func (b *Broadcast) finish(err error) {
+	b.mu.Lock()
+	b.done = true
+	b.err = err
+	if b.idle != nil {
+		b.idle.Stop()
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	streams.Lock()
+	if streams.m[b.taskID] == b {
+		delete(streams.m, b.taskID)
+	}
+	streams.Unlock()
+}
+
+// subscribe 新观众从头开始读。推流已停止时返回 nil，开头已被覆盖时返回 ErrStreamStarted
+func (b *Broadcast) subscribe() (*StreamReader, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || (b.done && b.err != nil) {
+		return nil, nil
+	}
+	// 从中间开始的 MP4 没有 ftyp/moov，播放器无法解码
+	if b.start > 0 {
+		return nil, ErrStreamStarted
+	}
+	if b.idle != nil {
+		b.idle.Stop()
+		b.idle = nil
+	}
+	b.subs++
+	return &StreamReader{b: b}, nil
+}
+
+// leave 最后一个观众离开后稍等片刻，给断线重连留出时间
+func (b *Broadcast) leave(cancelTask bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs--; b.subs > 0 || b.done {
+		return
+	}
+	b.cancelTask = cancelTask
+	b.idle = time.AfterFunc(streamIdleGrace, func() {
+		b.mu.Lock()
+		idle := b.subs == 0 && !b.done
+		if idle {
+			b.closed = true
+		}
+		cancel, cancelTask := b.cancel, b.cancelTask
+		b.mu.Unlock()
+		if !idle {
+			return
+		}
+		cancel(nil)
+		if cancelTask {
+			cancelUnstartedTask(b.taskID)
+		}
+	})
+}
+
+// cancelUnstartedTask 直接观看的客户端都已断开，取消队列还没开始的任务。
+// 这时推流是任务唯一的下载；队列已经在下载的任务不受影响
+func cancelUnstartedTask(taskID uint) {
+	t, err := dao.GetTaskByID(taskID)
+	if err != nil {
+		log.Error("stream task:%d load err:%v", taskID, err)
+		return
+	}
+	if _, err = cancelTask(t, models.StatusPending); err != nil {
+		log.Error("stream task:%d cancel err:%v", taskID, err)
+	}
+}
+
+// StreamReader 一个观众的读取位置
+type StreamReader struct {
+	b          *Broadcast
+	off        int64
+	closed     bool
+	cancelTask bool // 直接观看的客户端，见 JoinStream
+}
+
+// Read 没有新数据时阻塞，推流结束且读完后返回 io.EOF
+func (r *StreamReader) Read(p []byte) (int, error) {
+	b := r.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for r.off == b.end && !b.done && !r.closed {
+		b.cond.Wait()
+	}
+	switch {
+	case r.closed:
+		return 0, io.ErrClosedPipe
+	case r.off < b.start:
+		return 0, ErrStreamLagged
+	case r.off == b.end:
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+	size := int64(len(b.buf))
+	pos := r.off % size
+	n := int64(len(p))
+	if n > b.end-r.off {
+		n = b.end - r.off
+	}
+	if n > size-pos {
+		n = size - pos
+	}
+	copy(p, b.buf[pos:pos+n])
+	r.off += n
+	return int(n), nil
+}
+
+// Close 离开推流，可重复调用
+func (r *StreamReader) Close() error {
+	b := r.b
+	b.mu.Lock()
+	if r.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	b.leave(r.cancelTask)
+	return nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"minodl/mdb"
+	"minodl/models"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// withoutRedis 额度检查连不上 Redis 时放行
+func withoutRedis(t *testing.T) {
+	t.Helper()
+	saved := mdb.Redis
+	mdb.Redis = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 50 * time.Millisecond, MaxRetries: -1})
+	t.Cleanup(func() {
+		_ = mdb.Redis.Close()
+		mdb.Redis = saved
+	})
+}
+
+// startTestBroadcast 与 JoinStream 相同，但不占用并发名额
+func startTestBroadcast(t *testing.T, task *models.Task, size int) (*Broadcast, *StreamReader) {
+	t.Helper()
+	b := &Broadcast{taskID: task.ID, buf: make([]byte, size)}
+	b.cond = sync.NewCond(&b.mu)
+	r, err := b.subscribe()
+	if err != nil || r == nil {
+		t.Fatalf("subscribe: %v, %v", r, err)
+	}
+	streams.Lock()
+	streams.m[task.ID] = b
+	streams.Unlock()
+	t.Cleanup(func() { b.stop(nil) })
+	b.run(task, func() {})
+	return b, r
+}
+
+func expectNoEvents(t *testing.T, events <-chan TaskEvent) {
+	t.Helper()
+	select {
+	case ev := <-events:
+		t.Fatalf("stream published a task event: %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStreamDoesNotTouchTask(t *testing.T) {
+	withoutRedis(t)
+	fake := &FakeExtractor{Content: []byte("ftyp moov mdat")}
+	withExtractors(t, map[string][]string{"stream.test": {"fake"}}, fake)
+	task := &models.Task{ID: 9001, SourceURL: "https://stream.test/v/1", Status: models.StatusPending}
+	events, unsubscribe := Events.SubscribeTask(task.ID)
+	defer unsubscribe()
+
+	_, r := startTestBroadcast(t, task, 1024)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	if string(data) != string(fake.Content) {
+		t.Fatalf("stream = %q, want %q", data, fake.Content)
+	}
+	_ = r.Close()
+	if task.Status != models.StatusPending || task.Progress != 0 || task.FilePath != "" || task.DownloadedBytes != 0 {
+		t.Fatalf("finished stream changed the task: %+v", task)
+	}
+	expectNoEvents(t, events)
+}
+
+func TestStoppedStreamKeepsQueueDownload(t *testing.T) {
+	withoutRedis(t)
+	fake := &FakeExtractor{Content: []byte("head"), Hold: make(chan struct{})}
+	withExtractors(t, map[string][]string{"stream.test": {"fake"}}, fake)
+	task := &models.Task{ID: 9002, SourceURL: "https://stream.test/v/2", Status: models.StatusRunning}
+	// 队列正在下载同一任务
+	queueCtx, done := TrackProcess(context.Background(), task.ID)
+	defer done()
+	events, unsubscribe := Events.SubscribeTask(task.ID)
+	defer unsubscribe()
+
+	b, r := startTestBroadcast(t, task, 1024)
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	// 观众全部离开后的空闲停止
+	b.stop(nil)
+	if _, err := io.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Fatalf("read after stop: %v, want context.Canceled", err)
+	}
+	if queueCtx.Err() != nil {
+		t.Fatal("stopping the stream cancelled the queue download")
+	}
+	if task.Status != models.StatusRunning {
+		t.Fatalf("stopped stream set task status to %s", task.Status)
+	}
+	expectNoEvents(t, events)
+	if r2, err := b.subscribe(); r2 != nil || err != nil {
+		t.Fatalf("stopped stream accepted a viewer: %v, %v", r2, err)
+	}
+}
+
+func TestCancelEventStopsStream(t *testing.T) {
+	withoutRedis(t)
+	fake := &FakeExtractor{Content: []byte("head"), Hold: make(chan struct{})}
+	withExtractors(t, map[string][]string{"stream.test": {"fake"}}, fake)
+	task := &models.Task{ID: 9003, SourceURL: "https://stream.test/v/3", Status: models.StatusRunning}
+
+	_, r := startTestBroadcast(t, task, 1024)
+	Events.dispatch(TaskEvent{Type: EventStatus, TaskID: task.ID, Status: models.StatusCancelled})
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrTaskCancelled) {
+		t.Fatalf("read after cancel: %v, want ErrTaskCancelled", err)
+	}
+}
+
+func TestLateJoinAfterHeadOverwritten(t *testing.T) {
+	b := &Broadcast{buf: make([]byte, 8)}
+	b.cond = sync.NewCond(&b.mu)
+	_, _ = b.Write([]byte("ftypmoov"))
+	r, err := b.subscribe()
+	if err != nil || r == nil {
+		t.Fatalf("join with head buffered: %v, %v", r, err)
+	}
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(r, head); err != nil || string(head) != "ftyp" {
+		t.Fatalf("late joiner read %q, %v", head, err)
+	}
+	_, _ = b.Write([]byte("mdat"))
+	if r, err = b.subscribe(); !errors.Is(err, ErrStreamStarted) {
+		t.Fatalf("join after head overwritten: %v, %v, want ErrStreamStarted", r, err)
+	}
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"minodl/config"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/models"
+	"minodl/storage"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cacheEvictInterval = 10 * time.Minute
+	cacheEvictBatch    = 50
+)
+
+// 分享链接里与内容无关的统计参数
+var trackingParams = map[string]bool{
+	"spm_id_from":   true,
+	"vd_source":     true,
+	"share_source":  true,
+	"share_medium":  true,
+	"share_plat":    true,
+	"share_session": true,
+	"si":            true,
+	"feature":       true,
+}
+
+// normalizeSourceURL 去掉协议、www/m 前缀、锚点和统计参数的差异
+func normalizeSourceURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	host = strings.TrimPrefix(host, "m.")
+	q := u.Query()
+	for k := range q {
+		if strings.HasPrefix(k, "utm_") || trackingParams[k] {
+			q.Del(k)
+		}
+	}
+	out := "https://" + host + strings.TrimRight(u.Path, "/")
+	// Encode 按参数名排序
+	if enc := q.Encode(); enc != "" {
+		out += "?" + enc
+	}
+	return out
+}
+
+// mediaCacheKey 同一视频、格式和后处理得到的文件相同。
+// 有 extractor 和视频 ID 时按 ID 去重，不同分享链接指向同一视频也能命中；否则退回规范化的链接
+func mediaCacheKey(extractor, videoID, sourceURL, spec, variant string) string {
+	source := strings.ToLower(extractor) + ":" + videoID
+	if extractor == "" || videoID == "" {
+		source = normalizeSourceURL(sourceURL)
+	}
+	sum := sha256.Sum256([]byte(source + "|" + spec + "|" + variant))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheVariant 同一视频和格式下，后处理和字幕选项不同时结果也不同
+func cacheVariant(t *models.Task) string {
+	if v := subtitleVariant(t); v != "" {
+		return t.Profile + "|" + v
+	}
+	return t.Profile
+}
+
+// lookupMediaCache 命中时增加引用计数，文件已丢失的缓存项视为未命中
+func lookupMediaCache(ctx context.Context, cacheKey string) *models.MediaCache {
+	entry, err := dao.GetMediaCacheByKey(cacheKey)
+	if err != nil {
+		return nil
+	}
+	for _, key := range []string{entry.FilePath, entry.ProcessedPath} {
+		if key == "" {
+			continue
+		}
+		if _, err = storage.Store.Stat(ctx, key); err != nil {
+			log.Warn("media cache:%d missing %s err:%v", entry.ID, key, err)
+			_ = dao.DeleteMediaCache(entry.ID)
+			return nil
+		}
+	}
+	// 被淘汰的缓存项不再可用
+	if ok, err := dao.AcquireMediaCache(entry.ID); err != nil || !ok {
+		return nil
+	}
+	return entry
+}
+
+// applyMediaCache 任务直接引用缓存文件，不再下载
+func applyMediaCache(t *models.Task, entry *models.MediaCache) {
+	t.Status = models.StatusCompleted
+	t.Progress = 100
+	t.FilePath = entry.FilePath
+	t.VideoURL = entry.FilePath
+	t.ProcessedPath = entry.ProcessedPath
+	t.SubtitlePaths = entry.SubtitlePaths
+	if entry.ProcessedPath != "" {
+		t.ProfileStatus = models.StatusCompleted
+		t.ProfileProgress = 100
+	}
+	t.CacheID = entry.ID
+	t.Cached = true
+}
+
+// mediaFiles 一次下载产生的本地文件
+type mediaFiles struct {
+	video     string
+	processed string
+	subtitles []string
+	partial   bool // 后处理失败，结果不完整，不进入缓存
+}
+
+// storeMedia 按内容哈希转存下载结果并登记缓存，内容相同的文件只保存一份
+func storeMedia(ctx context.Context, t *models.Task, files mediaFiles) error {
+	sum, size, err := fileSHA256(files.video)
+	if err != nil {
+		return err
+	}
+	// 附属文件 <id>.<suffix> -> media/<sha256>.<suffix>
+	prefix := strconv.FormatUint(uint64(t.ID), 10)
+	related := func(local string) (string, error) {
+		st, err := os.Stat(local)
+		if err != nil {
+			return "", err
+		}
+		size += st.Size()
+		key := "media/" + sum + strings.TrimPrefix(filepath.Base(local), prefix)
+		return key, putContent(ctx, key, local)
+	}
+	processedKey := ""
+	if files.processed != "" {
+		if processedKey, err = related(files.processed); err != nil {
+			return err
+		}
+	}
+	subtitleKeys := make([]string, 0, len(files.subtitles))
+	for _, sub := range files.subtitles {
+		key, err := related(sub)
+		if err != nil {
+			return err
+		}
+		subtitleKeys = append(subtitleKeys, key)
+	}
+	key := "media/" + sum + filepath.Ext(files.video)
+	if err = putContent(ctx, key, files.video); err != nil {
+		return err
+	}
+	t.FilePath = key
+	t.VideoURL = key
+	t.ProcessedPath = processedKey
+	t.SubtitlePaths = subtitleKeys
+
+	if t.CacheKey == "" || files.partial {
+		return nil
+	}
+	entry := &models.MediaCache{
+		CacheKey:      t.CacheKey,
+		SourceURL:     normalizeSourceURL(t.SourceURL),
+		FormatSpec:    downloadFormatSpec(t),
+		Profile:       t.Profile,
+		FilePath:      key,
+		ProcessedPath: processedKey,
+		SubtitlePaths: subtitleKeys,
+		SHA256:        sum,
+		Size:          size,
+		RefCount:      1,
+		LastUsedAt:    time.Now(),
+	}
+	if err = dao.CreateMediaCache(entry); err != nil {
+		// 同一内容被并发下载，改为引用先登记的缓存项
+		existing := lookupMediaCache(ctx, t.CacheKey)
+		if existing == nil {
+			log.Error("task:%d register media cache err:%v", t.ID, err)
+			return nil
+		}
+		applyMediaCache(t, existing)
+		t.Cached = false
+		deleteUnusedMedia(ctx, key, processedKey, subtitleKeys)
+		return nil
+	}
+	t.CacheID = entry.ID
+	return nil
+}
+
+// releaseTaskMedia 任务删除后释放缓存引用，未进入缓存的文件没有其他引用时直接删除
+func releaseTaskMedia(ctx context.Context, t *models.Task) {
+	if t.CacheID != 0 {
+		if err := dao.ReleaseMediaCache(t.CacheID); err != nil {
+			log.Error("task:%d release media cache:%d err:%v", t.ID, t.CacheID, err)
+		}
+		return
+	}
+	deleteUnusedMedia(ctx, t.FilePath, t.ProcessedPath, t.SubtitlePaths)
+}
+
+// putContent 内容寻址的 key 已存在时跳过上传
+func putContent(ctx context.Context, key, localPath string) error {
+	if _, err := storage.Store.Stat(ctx, key); err == nil {
+		return os.Remove(localPath)
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return storage.Store.PutFile(ctx, key, localPath)
+}
+
+// deleteUnusedMedia 原文件不再被引用时连同字幕一起删除
+func deleteUnusedMedia(ctx context.Context, file, processed string, subtitles []string) {
+	deleteUnusedObject(ctx, processed)
+	if !deleteUnusedObject(ctx, file) {
+		return
+	}
+	for _, key := range subtitles {
+		deleteObject(ctx, key)
+	}
+}
+
+// deleteUnusedObject 没有任务和缓存项再引用时才删除存储对象
+func deleteUnusedObject(ctx context.Context, key string) bool {
+	if key == "" {
+		return false
+	}
+	if n, err := dao.CountTasksByFile(key); err != nil || n > 0 {
+		return false
+	}
+	if n, err := dao.CountMediaCacheByFile(key); err != nil || n > 0 {
+		return false
+	}
+	deleteObject(ctx, key)
+	return true
+}
+
+func deleteObject(ctx context.Context, key string) {
+	if err := storage.Store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Error("delete %s err:%v", key, err)
+	}
+}
+
+func fileSHA256(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// EvictMediaCache 缓存总量超过上限时，按最近使用时间淘汰没有任务引用的条目
+func EvictMediaCache(ctx context.Context, maxBytes int64) (int, error) {
+	if maxBytes <= 0 {
+		return 0, nil
+	}
+	total, err := dao.MediaCacheTotalSize()
+	if err != nil {
+		return 0, err
+	}
+	evicted := 0
+	for total > maxBytes && ctx.Err() == nil {
+		entries, err := dao.ListUnreferencedMediaCache(cacheEvictBatch)
+		if err != nil {
+			return evicted, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, e := range entries {
+			if total <= maxBytes {
+				break
+			}
+			// 期间又被新任务引用时跳过
+			ok, err := dao.DeleteUnreferencedMediaCache(e.ID)
+			if err != nil {
+				return evicted, err
+			}
+			if !ok {
+				continue
+			}
+			deleteUnusedMedia(ctx, e.FilePath, e.ProcessedPath, e.SubtitlePaths)
+			total -= e.Size
+			evicted++
+		}
+	}
+	return evicted, nil
+}
+
+// InitMediaCache 定期淘汰媒体缓存，cache_max_bytes 为 0 时不淘汰
+func InitMediaCache(cfg *config.Config) *Janitor {
+	if cfg.CacheMaxBytes <= 0 {
+		return &Janitor{}
+	}
+	return startJanitor(cacheEvictInterval, func(ctx context.Context) {
+		if n, err := EvictMediaCache(ctx, cfg.CacheMaxBytes); err != nil {
+			log.Error("evict media cache err:%v", err)
+		} else if n > 0 {
+			log.Info("evicted %d media cache entries", n)
+		}
+	})
+}
@@ -0,0 +1,414 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minodl/config"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/models"
+	"minodl/utils"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxCookieFileBytes = 1 << 20
+
+var (
+	ErrCredentialInput  = errors.New("cookies or username and password required")
+	ErrCredentialDomain = errors.New("invalid domain")
+	ErrNoSiteCookies    = errors.New("no cookies for this domain in the file")
+	ErrCookiesExpired   = errors.New("the login cookies in the file have already expired")
+
+	credentialDomainRe = regexp.MustCompile(`^([a-z0-9-]+\.)+[a-z]{2,}$`)
+)
+
+// 短链和备用域名，登录信息按主域名保存
+var siteAliases = map[string]string{
+	"youtu.be":      YouTube,
+	"b23.tv":        BILIBILI,
+	"iesdouyin.com": DouYin,
+	"xhslink.com":   XHS,
+}
+
+// 各站点代表登录态的 cookie，用它们的过期时间估算登录何时失效
+var loginCookies = map[string][]string{
+	YouTube:  {"SID", "__Secure-1PSID", "__Secure-3PSID", "LOGIN_INFO"},
+	BILIBILI: {"SESSDATA"},
+	DouYin:   {"sessionid", "sessionid_ss"},
+	XHS:      {"web_session"},
+}
+
+// CredentialInput 上传的登录信息，cookies 为 Netscape 格式的 cookie 文件
+type CredentialInput struct {
+	Cookies  string `json:"cookies"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type passwordSecret struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// netscapeCookie cookie 文件中的一行
+type netscapeCookie struct {
+	domain   string
+	path     string
+	secure   bool
+	expires  int64 // 0 表示会话 cookie
+	name     string
+	value    string
+	httpOnly bool
+}
+
+func credentialKey() string {
+	if key := config.Get().CredentialKey; key != "" {
+		return key
+	}
+	return config.Get().JWTSecret
+}
+
+// NormalizeCredentialDomain 去掉协议、www 前缀，短链域名换成主域名
+func NormalizeCredentialDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if u, err := url.Parse(domain); err == nil && u.Host != "" {
+		domain = u.Hostname()
+	}
+	domain = strings.TrimPrefix(strings.TrimPrefix(domain, "."), "www.")
+	if alias, ok := siteAliases[domain]; ok {
+		domain = alias
+	}
+	if !credentialDomainRe.MatchString(domain) {
+		return "", ErrCredentialDomain
+	}
+	return domain, nil
+}
+
+// SaveCredential 加密保存用户在某个站点的 cookie 或账号密码，重新上传时覆盖
+func SaveCredential(userID uint, domain string, in CredentialInput) (*models.SiteCredential, error) {
+	domain, err := NormalizeCredentialDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	c := &models.SiteCredential{UserID: userID, Domain: domain, Status: models.CredentialValid}
+	var plain []byte
+	switch {
+	case strings.TrimSpace(in.Cookies) != "":
+		if len(in.Cookies) > maxCookieFileBytes {
+			return nil, errors.New("cookie file too large")
+		}
+		// 只保留该站点的 cookie，其它站点的不保存
+		cookies := filterCookies(parseCookieFile(in.Cookies), domain)
+		if len(cookies) == 0 {
+			return nil, ErrNoSiteCookies
+		}
+		c.Kind = models.CredentialCookies
+		c.CookieCount = len(cookies)
+		c.ExpiresAt = cookieExpiry(cookies, domain)
+		if c.ExpiresAt != nil && c.ExpiresAt.Before(time.Now()) {
+			return nil, ErrCookiesExpired
+		}
+		plain = []byte(formatCookieFile(cookies))
+	case in.Username != "" && in.Password != "":
+		c.Kind = models.CredentialPassword
+		c.Username = in.Username
+		if plain, err = json.Marshal(passwordSecret{Username: in.Username, Password: in.Password}); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrCredentialInput
+	}
+	if c.Secret, err = utils.EncryptString(credentialKey(), plain); err != nil {
+		return nil, err
+	}
+	if err = dao.SaveCredential(c); err != nil {
+		return nil, err
+	}
+	return dao.GetCredential(userID, domain)
+}
+
+// ListCredentials 用户保存的登录信息，登录 cookie 已过期的显示为 expired
+func ListCredentials(userID uint) ([]models.SiteCredential, error) {
+	list, err := dao.ListCredentials(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if credentialExpired(&list[i]) {
+			list[i].Status = models.CredentialExpired
+		}
+	}
+	return list, nil
+}
+
+func DeleteCredential(userID uint, domain string) (bool, error) {
+	domain, err := NormalizeCredentialDomain(domain)
+	if err != nil {
+		return false, err
+	}
+	return dao.DeleteCredential(userID, domain)
+}
+
+func credentialExpired(c *models.SiteCredential) bool {
+	return c.Status == models.CredentialExpired || (c.ExpiresAt != nil && c.ExpiresAt.Before(time.Now()))
+}
+
+// parseCookieFile 解析 Netscape cookie 文件，#HttpOnly_ 前缀的行是 HttpOnly cookie
+func parseCookieFile(content string) []netscapeCookie {
+	var out []netscapeCookie
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			line = rest
+			httpOnly = true
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 || fields[5] == "" {
+			continue
+		}
+		expires, _ := strconv.ParseInt(fields[4], 10, 64)
+		out = append(out, netscapeCookie{
+			domain:   fields[0],
+			path:     fields[2],
+			secure:   strings.EqualFold(fields[3], "TRUE"),
+			expires:  expires,
+			name:     fields[5],
+			value:    fields[6],
+			httpOnly: httpOnly,
+		})
+	}
+	return out
+}
+
+func filterCookies(cookies []netscapeCookie, domain string) []netscapeCookie {
+	var out []netscapeCookie
+	for _, c := range cookies {
+		if domainMatch(strings.TrimPrefix(strings.ToLower(c.domain), "."), domain) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// domainMatch host 等于 domain 或是它的子域名
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func formatCookieFile(cookies []netscapeCookie) string {
+	var b strings.Builder
+	b.WriteString("# Netscape HTTP Cookie File\n")
+	for _, c := range cookies {
+		domain := c.domain
+		if c.httpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		flag := "FALSE"
+		if strings.HasPrefix(c.domain, ".") {
+			flag = "TRUE"
+		}
+		secure := "FALSE"
+		if c.secure {
+			secure = "TRUE"
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, flag, c.path, secure, c.expires, c.name, c.value)
+	}
+	return b.String()
+}
+
+// cookieExpiry 已知站点取登录 cookie 中最早的过期时间；其它站点取最晚的，之后整个文件都不可用
+func cookieExpiry(cookies []netscapeCookie, domain string) *time.Time {
+	names := loginCookies[domain]
+	var earliest, latest int64
+	for _, c := range cookies {
+		if c.expires <= 0 {
+			continue
+		}
+		if latest == 0 || c.expires > latest {
+			latest = c.expires
+		}
+		for _, name := range names {
+			if c.name == name && (earliest == 0 || c.expires < earliest) {
+				earliest = c.expires
+			}
+		}
+	}
+	at := earliest
+	if at == 0 {
+		at = latest
+	}
+	if at == 0 {
+		return nil
+	}
+	t := time.Unix(at, 0)
+	return &t
+}
+
+// SiteAuth 解析和下载某个用户的任务时使用的登录信息
+type SiteAuth struct {
+	credentialID uint
+	domain       string
+	cookies      []netscapeCookie
+	username     string
+	password     string
+
+	once     sync.Once
+	authFile string // cookie 文件或带账号密码的 yt-dlp 配置文件
+	fileErr  error
+}
+
+// siteAuthFor 用户在链接所属站点保存的登录信息，没有或已失效时返回 nil
+func siteAuthFor(userID uint, videoUrl string) (*SiteAuth, error) {
+	if userID == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(strings.TrimSpace(videoUrl))
+	if err != nil || u.Host == "" {
+		return nil, nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for alias, domain := range siteAliases {
+		if domainMatch(host, alias) {
+			host = domain
+		}
+	}
+	list, err := dao.ListCredentials(userID)
+	if err != nil {
+		return nil, err
+	}
+	// 最具体的域名优先
+	var best *models.SiteCredential
+	for i := range list {
+		c := &list[i]
+		if domainMatch(host, c.Domain) && (best == nil || len(c.Domain) > len(best.Domain)) {
+			best = c
+		}
+	}
+	if best == nil || credentialExpired(best) {
+		return nil, nil
+	}
+	plain, err := utils.DecryptString(credentialKey(), best.Secret)
+	if err != nil {
+		// 密钥更换后无法解密，需要重新上传
+		log.Error("decrypt credential %d err:%v", best.ID, err)
+		credentialRejected(&SiteAuth{credentialID: best.ID, domain: best.Domain}, "stored credential can no longer be decrypted")
+		return nil, nil
+	}
+	auth := &SiteAuth{credentialID: best.ID, domain: best.Domain}
+	if best.Kind == models.CredentialPassword {
+		var p passwordSecret
+		if err = json.Unmarshal(plain, &p); err != nil {
+			return nil, err
+		}
+		auth.username, auth.password = p.Username, p.Password
+	} else {
+		auth.cookies = parseCookieFile(string(plain))
+	}
+	return auth, nil
+}
+
+// ytdlpArgs cookie 或账号密码写到只有本进程用户可读的临时文件，由 Close 删除。
+// 密码不放在命令行参数里，其他用户能通过 ps 看到
+func (a *SiteAuth) ytdlpArgs() ([]string, error) {
+	if a == nil {
+		return nil, nil
+	}
+	pattern, flag := "minodl-cookies-*.txt", "--cookies"
+	if a.username != "" {
+		pattern, flag = "minodl-auth-*.conf", "--config-locations"
+	}
+	a.once.Do(func() {
+		content := formatCookieFile(a.cookies)
+		if a.username != "" {
+			content = "--username " + configQuote(a.username) + "\n--password " + configQuote(a.password) + "\n"
+		}
+		// CreateTemp 创建的文件权限是 0600
+		f, err := os.CreateTemp("", pattern)
+		if err != nil {
+			a.fileErr = err
+			return
+		}
+		a.authFile = f.Name()
+		if _, err = f.WriteString(content); err != nil {
+			a.fileErr = err
+		}
+		if err = f.Close(); err != nil && a.fileErr == nil {
+			a.fileErr = err
+		}
+	})
+	if a.fileErr != nil {
+		return nil, a.fileErr
+	}
+	return []string{flag, a.authFile}, nil
+}
+
+// configQuote yt-dlp 按 shell 规则拆分配置文件，值放在单引号里
+func configQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// cookieHeader 原生后端请求页面时带上的 Cookie
+func (a *SiteAuth) cookieHeader(host string) string {
+	if a == nil {
+		return ""
+	}
+	now := time.Now().Unix()
+	var parts []string
+	for _, c := range a.cookies {
+		if c.expires > 0 && c.expires < now {
+			continue
+		}
+		if domainMatch(strings.ToLower(host), strings.TrimPrefix(strings.ToLower(c.domain), ".")) {
+			parts = append(parts, c.name+"="+c.value)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Close 删除临时 cookie 文件
+func (a *SiteAuth) Close() {
+	if a != nil && a.authFile != "" {
+		_ = os.Remove(a.authFile)
+	}
+}
+
+// credentialUsed 登录信息被站点接受
+func credentialUsed(a *SiteAuth) {
+	if a == nil {
+		return
+	}
+	if err := dao.TouchCredential(a.credentialID); err != nil {
+		log.Error("touch credential %d err:%v", a.credentialID, err)
+	}
+}
+
+// credentialRejected 带着登录信息仍被要求登录，说明 cookie 已失效，标记后不再使用直到用户重新上传
+func credentialRejected(a *SiteAuth, reason string) {
+	if a == nil {
+		return
+	}
+	log.Info("credential %d for %s rejected: %s", a.credentialID, a.domain, reason)
+	if err := dao.UpdateCredentialStatus(a.credentialID, models.CredentialExpired, truncate(reason, maxErrorMsgLen)); err != nil {
+		log.Error("update credential %d err:%v", a.credentialID, err)
+	}
+}
+
+// authFailure 解析失败时判断是否是登录信息失效，返回给用户的错误说明需要重新上传
+func authFailure(a *SiteAuth, err error) error {
+	if a == nil || ClassifyFailure(err.Error(), err) != FailLoginRequired {
+		return err
+	}
+	credentialRejected(a, err.Error())
+	return fmt.Errorf("%s: cookies for %s stopped working, please upload new ones: %w", FailCookiesExpired, a.domain, err)
+}
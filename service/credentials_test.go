@@ -0,0 +1,52 @@
+package service
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// 账号密码写在只有自己可读的配置文件里，不出现在命令行参数中
+func TestYtdlpArgsPasswordNotInArgv(t *testing.T) {
+	const password = `p'a ss"$(rm -rf /)\`
+	auth := &SiteAuth{username: "someone@example.com", password: password}
+	args, err := auth.ytdlpArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 2 || args[0] != "--config-locations" {
+		t.Fatalf("args = %q", args)
+	}
+	if slices.ContainsFunc(args, func(a string) bool { return strings.Contains(a, "p'a") }) {
+		t.Fatalf("password passed on the command line: %q", args)
+	}
+	st, err := os.Stat(args[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && st.Mode().Perm() != 0o600 {
+		t.Errorf("config file mode = %v, want 0600", st.Mode().Perm())
+	}
+	// yt-dlp 把整个文件按 shell 规则拆分，换行也是分隔符
+	if runtime.GOOS != "windows" {
+		out, err := exec.Command("sh", "-c", `eval "set -- $(tr '\n' ' ' <"$0")"; printf '%s\n' "$@"`, args[1]).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "--username\nsomeone@example.com\n--password\n" + password + "\n"
+		if string(out) != want {
+			t.Errorf("config splits into %q, want %q", out, want)
+		}
+	}
+	// 同一次任务重复调用使用同一个文件
+	if again, _ := auth.ytdlpArgs(); !slices.Equal(again, args) {
+		t.Errorf("second call = %q, want %q", again, args)
+	}
+	auth.Close()
+	if _, err = os.Stat(args[1]); !os.IsNotExist(err) {
+		t.Errorf("config file kept after Close: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"minodl/config"
+	"minodl/log"
+	"minodl/models"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDownloadDir = "./runtime/videos"
+	maxErrorMsgLen     = 1024
+	progressInterval   = time.Second
+)
+
+// DownloadDir yt-dlp 下载的临时目录，完成后转存到存储后端
+func DownloadDir() string {
+	if dir := config.Get().DownloadDir; dir != "" {
+		return dir
+	}
+	return defaultDownloadDir
+}
+
+// runDownload 通过下载后端把任务下载到磁盘，并通过 dao.UpdateTask 持久化进度和状态
+func runDownload(ctx context.Context, t *models.Task) error {
+	tracker := NewTaskTracker(t)
+	tracker.worker = true
+	dir := DownloadDir()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return tracker.Fail(err)
+	}
+	// 只使用任务所属用户自己的登录信息
+	auth, err := siteAuthFor(t.UserID, t.SourceURL)
+	if err != nil {
+		return tracker.FailOrRetry(err)
+	}
+	defer auth.Close()
+	tracker.auth = auth
+	// 并发已满时延后重新入队，流量用完则失败
+	release, err := acquireDownloadSlot(t.UserID, "task:"+strconv.FormatUint(uint64(t.ID), 10))
+	if IsConcurrentQuota(err) && Queue != nil {
+		deferTask(tracker, quotaRetryDelay)
+		return err
+	}
+	if err != nil {
+		return tracker.FailCode(FailQuota, err)
+	}
+	defer release()
+	ctx, done := TrackProcess(ctx, t.ID)
+	defer done()
+	_ = tracker.SetStatus(models.StatusRunning)
+	filePath, err := downloadVideo(ctx, DownloadRequest{
+		URL:        t.SourceURL,
+		FormatSpec: downloadFormatSpec(t),
+		Dir:        dir,
+		Name:       strconv.FormatUint(uint64(t.ID), 10),
+		Subtitles:  taskSubtitles(t),
+		Tracker:    tracker,
+		Auth:       auth,
+	})
+	if err != nil {
+		if err := interrupted(ctx, tracker); err != nil {
+			return err
+		}
+		return tracker.FailOrRetry(err)
+	}
+	credentialUsed(auth)
+	// 流量按下载到的原文件计，后处理失败也已经消耗
+	if st, err := os.Stat(filePath); err == nil {
+		addBytesUsage(t.UserID, t.ID, st.Size())
+	}
+
+	t.ErrorMsg = ""
+	t.ErrorCode = ""
+	files := mediaFiles{video: filePath, subtitles: collectSubtitles(t)}
+
+	// 后处理失败时保留原文件，任务仍然完成
+	if t.SubMode == SubtitleBurn {
+		if burned, err := burnSubtitles(ctx, tracker, filePath, files.subtitles); err != nil {
+			if err := interrupted(ctx, tracker); err != nil {
+				return err
+			}
+			postprocessFailed(tracker, "burn subtitles", err)
+			files.partial = true
+		} else {
+			files.video = burned
+		}
+	}
+	if profile, ok := GetProfile(t.Profile); ok {
+		if files.processed, err = runPostprocess(ctx, tracker, profile, files.video); err != nil {
+			if err := interrupted(ctx, tracker); err != nil {
+				return err
+			}
+			t.ProfileStatus = models.StatusFailed
+			postprocessFailed(tracker, "postprocess", err)
+			files.partial = true
+		} else {
+			t.ProfileStatus = models.StatusCompleted
+		}
+	}
+
+	// 按内容转存到存储后端并登记媒体缓存，任务只记录 key
+	if err = storeMedia(ctx, t, files); err != nil {
+		cleanPartialFiles(t.ID)
+		return tracker.FailCode(FailStorage, err)
+	}
+	log.Info("task:%d downloaded to %s", t.ID, t.FilePath)
+	return tracker.SetStatus(models.StatusCompleted)
+}
+
+// postprocessFailed 发布后处理失败事件
+func postprocessFailed(tracker *TaskTracker, stage string, err error) {
+	t := tracker.t
+	log.Error("task:%d %s err:%v", t.ID, stage, err)
+	t.ErrorMsg = truncate(stage+": "+err.Error(), maxErrorMsgLen)
+	ev := tracker.event(EventError)
+	ev.Stage = StagePostprocess
+	ev.Error = t.ErrorMsg
+	Events.Publish(ev)
+}
+
+// interrupted 处理用户取消和节点退出，未中断时返回 nil
+func interrupted(ctx context.Context, tracker *TaskTracker) error {
+	if IsCancelled(ctx) {
+		cleanPartialFiles(tracker.t.ID)
+		_ = tracker.Cancel()
+		return ErrTaskCancelled
+	}
+	// 节点退出时放回 pending，等待重新调度
+	if ctx.Err() != nil {
+		cleanPartialFiles(tracker.t.ID)
+		resetProgress(tracker.t)
+		_ = tracker.SetStatus(models.StatusPending)
+		return ctx.Err()
+	}
+	return nil
+}
+
+// deferTask 放回 pending 稍后再执行，不计入重试次数
+func deferTask(tracker *TaskTracker, delay time.Duration) {
+	t := tracker.t
+	t.Attempts--
+	at := time.Now().Add(delay)
+	t.NextRetryAt = &at
+	_ = tracker.SetStatus(models.StatusPending)
+	Queue.PushAt(t, at)
+}
+
+func downloadFormatSpec(t *models.Task) string {
+	if t.FormatSpec == "" {
+		return DefaultFormatSpec
+	}
+	return t.FormatSpec
+}
+
+func lastNonEmptyLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
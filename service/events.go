@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"minodl/log"
+	"minodl/models"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	EventProgress = "progress"
+	EventStatus   = "status"
+	EventError    = "error"
+
+	taskEventsChannel = "task:events"
+	subscriberBuffer  = 32
+	// 超过这么久没有新事件的最新进度不再保留，在其他节点结束或被删除的任务不会收到终止事件
+	latestTTL = 10 * time.Minute
+)
+
+// TaskEvent 任务进度/状态变化事件
+type TaskEvent struct {
+	Type     string            `json:"type"`
+	TaskID   uint              `json:"task_id"`
+	UserID   uint              `json:"user_id"`
+	Status   models.TaskStatus `json:"status"`
+	Progress float64           `json:"progress"` // percent of the current stage
+	Stage    string            `json:"stage,omitempty"`
+	// bytes and speed of the download stage
+	DownloadedBytes int64   `json:"downloaded_bytes,omitempty"`
+	TotalBytes      int64   `json:"total_bytes,omitempty"`
+	Speed           float64 `json:"speed,omitempty"`
+	ETA             int     `json:"eta,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	Code            string  `json:"code,omitempty"` // failure reason, see ClassifyFailure
+	Time            int64   `json:"time"`
+}
+
+// 跨节点广播的消息体，Node 用于忽略自己发出的消息
+type eventEnvelope struct {
+	Node  string    `json:"node"`
+	Event TaskEvent `json:"event"`
+}
+
+// Events 进程内任务事件中心
+var Events = NewHub()
+
+// Hub 进程内发布订阅，可选通过 Redis 在多个 dl 节点间转发
+type Hub struct {
+	mu       sync.RWMutex
+	node     string
+	taskSubs map[uint]map[chan TaskEvent]struct{}
+	userSubs map[uint]map[chan TaskEvent]struct{}
+	latest   map[uint]TaskEvent
+	swept    time.Time // 上次清理 latest 的时间
+	rdb      *redis.Client
+}
+
+func NewHub() *Hub {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &Hub{
+		node:     hex.EncodeToString(b),
+		taskSubs: make(map[uint]map[chan TaskEvent]struct{}),
+		userSubs: make(map[uint]map[chan TaskEvent]struct{}),
+		latest:   make(map[uint]TaskEvent),
+	}
+}
+
+// Relay 订阅 Redis 频道，把其它节点的事件分发给本地订阅者
+func (h *Hub) Relay(rdb *redis.Client) {
+	h.mu.Lock()
+	h.rdb = rdb
+	h.mu.Unlock()
+	go func() {
+		for {
+			h.relay(rdb)
+			log.Warn("task events relay end, node:%s", h.node)
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+func (h *Hub) relay(rdb *redis.Client) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("task events relay panic err:%v", err)
+		}
+	}()
+	ctx := context.Background()
+	psb := rdb.Subscribe(ctx, taskEventsChannel)
+	defer psb.Close()
+	if _, err := psb.Receive(ctx); err != nil {
+		log.Error("subscribe task events err:%v", err)
+		return
+	}
+	for msg := range psb.Channel() {
+		var env eventEnvelope
+		if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+			log.Error("task event payload err:%v", err)
+			continue
+		}
+		if env.Node == h.node {
+			continue
+		}
+		h.dispatch(env.Event)
+	}
+}
+
+// Publish 分发到本地订阅者，并广播到其它节点
+func (h *Hub) Publish(ev TaskEvent) {
+	if ev.Time == 0 {
+		ev.Time = time.Now().Unix()
+	}
+	h.dispatch(ev)
+	h.mu.RLock()
+	rdb := h.rdb
+	h.mu.RUnlock()
+	if rdb == nil {
+		return
+	}
+	payload, _ := json.Marshal(eventEnvelope{Node: h.node, Event: ev})
+	if err := rdb.Publish(context.Background(), taskEventsChannel, payload).Err(); err != nil {
+		log.Error("publish task event err:%v", err)
+	}
+}
+
+func (h *Hub) dispatch(ev TaskEvent) {
+	// 取消事件广播到所有节点，由持有进程的节点负责终止
+	if ev.Type == EventStatus && ev.Status == models.StatusCancelled {
+		cancelProcess(ev.TaskID)
+		stopStream(ev.TaskID)
+		if Queue != nil {
+			Queue.Remove(ev.TaskID)
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if isTerminal(ev.Status) {
+		delete(h.latest, ev.TaskID)
+	} else {
+		h.latest[ev.TaskID] = ev
+	}
+	h.sweepLatest(time.Now())
+	for ch := range h.taskSubs[ev.TaskID] {
+		send(ch, ev)
+	}
+	for ch := range h.userSubs[ev.UserID] {
+		send(ch, ev)
+	}
+}
+
+// sweepLatest 每隔 latestTTL 清理一次过期的最新进度，调用方持有写锁
+func (h *Hub) sweepLatest(now time.Time) {
+	if now.Sub(h.swept) < latestTTL {
+		return
+	}
+	h.swept = now
+	for id, ev := range h.latest {
+		if now.Sub(time.Unix(ev.Time, 0)) > latestTTL {
+			delete(h.latest, id)
+		}
+	}
+}
+
+// Forget 任务被删除，丢弃它的最新进度
+func (h *Hub) Forget(taskID uint) {
+	h.mu.Lock()
+	delete(h.latest, taskID)
+	h.mu.Unlock()
+}
+
+// 订阅者处理不过来时丢弃，避免阻塞下载
+func send(ch chan TaskEvent, ev TaskEvent) {
+	select {
+	case ch <- ev:
+	default:
+	}
+}
+
+// SubscribeTask 订阅单个任务，返回取消订阅函数
+func (h *Hub) SubscribeTask(taskID uint) (<-chan TaskEvent, func()) {
+	return h.subscribe(h.taskSubs, taskID)
+}
+
+// SubscribeUser 订阅用户所有任务
+func (h *Hub) SubscribeUser(userID uint) (<-chan TaskEvent, func()) {
+	return h.subscribe(h.userSubs, userID)
+}
+
+func (h *Hub) subscribe(subs map[uint]map[chan TaskEvent]struct{}, key uint) (<-chan TaskEvent, func()) {
+	ch := make(chan TaskEvent, subscriberBuffer)
+	h.mu.Lock()
+	if subs[key] == nil {
+		subs[key] = make(map[chan TaskEvent]struct{})
+	}
+	subs[key][ch] = struct{}{}
+	h.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(subs[key], ch)
+			if len(subs[key]) == 0 {
+				delete(subs, key)
+			}
+		})
+	}
+}
+
+// Snapshot 任务当前状态，优先使用内存中比数据库更新的进度
+func (h *Hub) Snapshot(t *models.Task) TaskEvent {
+	ev := TaskEvent{
+		Type:            EventStatus,
+		TaskID:          t.ID,
+		UserID:          t.UserID,
+		Status:          t.Status,
+		Progress:        t.Progress,
+		Stage:           t.Stage,
+		DownloadedBytes: t.DownloadedBytes,
+		TotalBytes:      t.TotalBytes,
+		Speed:           t.Speed,
+		ETA:             t.ETA,
+		Error:           t.ErrorMsg,
+		Code:            t.ErrorCode,
+		Time:            t.UpdatedAt.Unix(),
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if latest, ok := h.latest[t.ID]; ok && latest.Time >= ev.Time && time.Since(time.Unix(latest.Time, 0)) <= latestTTL {
+		ev.Status = latest.Status
+		ev.Progress = latest.Progress
+		ev.Stage = latest.Stage
+		ev.DownloadedBytes = latest.DownloadedBytes
+		ev.TotalBytes = latest.TotalBytes
+		ev.Speed = latest.Speed
+		ev.ETA = latest.ETA
+		ev.Time = latest.Time
+		// 进度事件不带失败原因，只有事件里有时才覆盖数据库中的
+		if latest.Code != "" {
+			ev.Error = latest.Error
+			ev.Code = latest.Code
+		}
+	}
+	return ev
+}
+
+func isTerminal(status models.TaskStatus) bool {
+	return status == models.StatusCompleted || status == models.StatusFailed || status == models.StatusCancelled
+}
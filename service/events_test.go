@@ -0,0 +1,55 @@
+package service
+
+import (
+	"minodl/models"
+	"testing"
+	"time"
+)
+
+func TestSnapshotKeepsFailureCode(t *testing.T) {
+	h := NewHub()
+	updated := time.Now().Add(-time.Minute)
+	task := &models.Task{ID: 1, Status: models.StatusPending, ErrorMsg: "HTTP Error 429", ErrorCode: FailRateLimited, UpdatedAt: updated}
+	if ev := h.Snapshot(task); ev.Code != FailRateLimited || ev.Error != "HTTP Error 429" {
+		t.Fatalf("snapshot from the task = %+v", ev)
+	}
+	// 重试中的进度事件不带失败原因，不能覆盖掉
+	h.dispatch(TaskEvent{Type: EventProgress, TaskID: 1, Status: models.StatusRunning, Progress: 30, Time: time.Now().Unix()})
+	ev := h.Snapshot(task)
+	if ev.Status != models.StatusRunning || ev.Progress != 30 || ev.Code != FailRateLimited {
+		t.Fatalf("snapshot with progress event = %+v", ev)
+	}
+	h.dispatch(TaskEvent{Type: EventStatus, TaskID: 1, Status: models.StatusPending, Error: "timed out", Code: FailNetwork, Time: time.Now().Unix()})
+	if ev = h.Snapshot(task); ev.Code != FailNetwork || ev.Error != "timed out" {
+		t.Fatalf("snapshot with failure event = %+v", ev)
+	}
+}
+
+func TestLatestEviction(t *testing.T) {
+	h := NewHub()
+	now := time.Now()
+	// 在其他节点结束的任务收不到终止事件
+	h.dispatch(TaskEvent{Type: EventProgress, TaskID: 1, Status: models.StatusRunning, Progress: 50, Time: now.Add(-2 * latestTTL).Unix()})
+	h.dispatch(TaskEvent{Type: EventProgress, TaskID: 2, Status: models.StatusRunning, Progress: 50, Time: now.Unix()})
+	task := &models.Task{ID: 1, Status: models.StatusCompleted, Progress: 100, UpdatedAt: now.Add(-3 * latestTTL)}
+	if ev := h.Snapshot(task); ev.Status != models.StatusCompleted {
+		t.Errorf("snapshot used an expired event: %+v", ev)
+	}
+
+	h.mu.Lock()
+	h.swept = time.Time{}
+	h.sweepLatest(now.Add(time.Minute))
+	_, stale := h.latest[1]
+	_, fresh := h.latest[2]
+	h.mu.Unlock()
+	if stale || !fresh {
+		t.Errorf("after sweep: stale kept %v, fresh kept %v", stale, fresh)
+	}
+
+	h.Forget(2)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.latest) != 0 {
+		t.Errorf("deleted task kept in latest: %v", h.latest)
+	}
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"minodl/log"
+	"minodl/models"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Extractor 解析和下载后端，yt-dlp 是其中之一，按域名路由，失败时按顺序换下一个
+type Extractor interface {
+	Name() string
+	// Probe 解析链接的元数据，播放列表只返回条目；auth 为用户在该站点的登录信息，可能为 nil
+	Probe(ctx context.Context, videoUrl string, auth *SiteAuth) (*models.VideoInfo, error)
+	// Formats 链接可下载的格式
+	Formats(ctx context.Context, videoUrl string, auth *SiteAuth) ([]models.VideoFormat, error)
+	// Download 下载到 Dir/Name.<ext> 并返回文件路径；Writer 非空时输出到流，不写文件
+	Download(ctx context.Context, req DownloadRequest) (string, error)
+	// Capabilities 后端在该域名上支持的功能，GET /sites 据此生成
+	Capabilities(domain string) Capabilities
+}
+
+// Capabilities 后端对某个站点的支持情况
+type Capabilities struct {
+	Playlists     bool // 播放列表、合集、分P
+	Subtitles     bool
+	AudioOnly     bool // 能单独下载音频流
+	Images        bool // 图集
+	LoginRequired bool // 不登录无法解析
+	MaxHeight     int  // 站点能提供的最高清晰度，0 表示不确定
+}
+
+// DownloadRequest 一次下载
+type DownloadRequest struct {
+	URL        string
+	FormatSpec string // yt-dlp 格式表达式，其他后端按清晰度近似选择
+	Dir        string
+	Name       string // 不含扩展名，字幕写到 Name.<lang>.<ext>
+	Subtitles  *SubtitleOptions
+	Writer     io.Writer
+	Tracker    *TaskTracker // 接收进度和错误输出
+	Auth       *SiteAuth    // 任务所属用户的登录信息
+}
+
+var ErrNoExtractor = errors.New("no extractor for url")
+
+// 已注册的后端和域名路由，没有匹配的域名使用 defaultChain
+var extractors = struct {
+	sync.RWMutex
+	byName       map[string]Extractor
+	routes       map[string][]string
+	defaultChain []string
+}{
+	byName:       make(map[string]Extractor),
+	routes:       make(map[string][]string),
+	defaultChain: []string{ExtractorYtDlp},
+}
+
+func init() {
+	RegisterExtractor(YtDlp{})
+	RegisterExtractor(DouyinExtractor{})
+	RegisterExtractor(XHSExtractor{})
+	RouteExtractors(BILIBILI, ExtractorYtDlp)
+	RouteExtractors("b23.tv", ExtractorYtDlp)
+	RouteExtractors(YouTube, ExtractorYtDlp)
+	RouteExtractors("youtu.be", ExtractorYtDlp)
+	// 抖音、小红书 yt-dlp 经常失效，优先原生解析
+	RouteExtractors(DouYin, ExtractorDouyin, ExtractorYtDlp)
+	RouteExtractors("iesdouyin.com", ExtractorDouyin, ExtractorYtDlp)
+	RouteExtractors(XHS, ExtractorXHS, ExtractorYtDlp)
+	RouteExtractors("xhslink.com", ExtractorXHS, ExtractorYtDlp)
+}
+
+// RegisterExtractor 注册后端，同名覆盖
+func RegisterExtractor(e Extractor) {
+	extractors.Lock()
+	extractors.byName[e.Name()] = e
+	extractors.Unlock()
+}
+
+// RouteExtractors 设置域名（含子域名）使用的后端，按顺序回退
+func RouteExtractors(domain string, names ...string) {
+	extractors.Lock()
+	extractors.routes[strings.ToLower(domain)] = names
+	extractors.Unlock()
+}
+
+// ExtractorsFor 链接对应的后端，最具体的域名优先，未注册的名字跳过
+func ExtractorsFor(videoUrl string) []Extractor {
+	host := ""
+	if u, err := url.Parse(strings.TrimSpace(videoUrl)); err == nil {
+		host = strings.ToLower(u.Hostname())
+	}
+	extractors.RLock()
+	defer extractors.RUnlock()
+	chain := extractors.defaultChain
+	for h := host; h != ""; {
+		if names, ok := extractors.routes[h]; ok {
+			chain = names
+			break
+		}
+		_, h, _ = strings.Cut(h, ".")
+	}
+	out := make([]Extractor, 0, len(chain))
+	for _, name := range chain {
+		if e, ok := extractors.byName[name]; ok {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// probeVideo 依次尝试后端解析，返回最后一个错误
+func probeVideo(ctx context.Context, videoUrl string, auth *SiteAuth) (*models.VideoInfo, error) {
+	err := ErrNoExtractor
+	for _, e := range ExtractorsFor(videoUrl) {
+		var info *models.VideoInfo
+		if info, err = e.Probe(ctx, videoUrl, auth); err == nil {
+			return info, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Error("extractor %s probe %s err:%v", e.Name(), videoUrl, err)
+	}
+	return nil, err
+}
+
+// downloadVideo 依次尝试后端下载。推流已经输出数据后不再回退，避免观众收到拼接的内容
+func downloadVideo(ctx context.Context, req DownloadRequest) (string, error) {
+	var w *countingWriter
+	if req.Writer != nil {
+		w = &countingWriter{w: req.Writer}
+		req.Writer = w
+	}
+	err := ErrNoExtractor
+	for _, e := range ExtractorsFor(req.URL) {
+		var file string
+		if file, err = e.Download(ctx, req); err == nil {
+			return file, nil
+		}
+		if ctx.Err() != nil || (w != nil && w.n > 0) {
+			return "", err
+		}
+		log.Error("extractor %s download %s err:%v", e.Name(), req.URL, err)
+		removeDownloadFiles(req)
+	}
+	return "", err
+}
+
+// removeDownloadFiles 换下一个后端前删除上一个留下的文件
+func removeDownloadFiles(req DownloadRequest) {
+	if req.Writer != nil || req.Name == "" {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(req.Dir, req.Name+".*"))
+	for _, f := range matches {
+		_ = os.Remove(f)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
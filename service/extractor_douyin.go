@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minodl/models"
+	"regexp"
+	"strings"
+)
+
+const ExtractorDouyin = "douyin"
+
+var (
+	douyinIDRe    = regexp.MustCompile(`/(video|note|slides)/(\d+)`)
+	douyinModalRe = regexp.MustCompile(`[?&]modal_id=(\d+)`)
+)
+
+// DouyinExtractor 解析分享页 window._ROUTER_DATA 中的作品数据，支持视频和图集
+type DouyinExtractor struct{}
+
+type douyinPage struct {
+	VideoInfoRes struct {
+		ItemList []douyinItem `json:"item_list"`
+	} `json:"videoInfoRes"`
+}
+
+type douyinItem struct {
+	AwemeID string `json:"aweme_id"`
+	Desc    string `json:"desc"`
+	Video   struct {
+		PlayAddr douyinURLs `json:"play_addr"`
+		Cover    douyinURLs `json:"cover"`
+		Width    int        `json:"width"`
+		Height   int        `json:"height"`
+		Duration float64    `json:"duration"` // 毫秒
+	} `json:"video"`
+	Images []douyinURLs `json:"images"`
+}
+
+type douyinURLs struct {
+	URI     string   `json:"uri"`
+	URLList []string `json:"url_list"`
+}
+
+func (d douyinURLs) first() string {
+	if len(d.URLList) == 0 {
+		return ""
+	}
+	return d.URLList[0]
+}
+
+func (DouyinExtractor) Name() string { return ExtractorDouyin }
+
+// Capabilities 分享页只有单个作品和一路 1080P 内的音视频
+func (DouyinExtractor) Capabilities(domain string) Capabilities {
+	return Capabilities{Images: true, MaxHeight: 1080}
+}
+
+func (DouyinExtractor) Probe(ctx context.Context, videoUrl string, auth *SiteAuth) (*models.VideoInfo, error) {
+	kind, id, err := douyinResolve(ctx, videoUrl, auth)
+	if err != nil {
+		return nil, err
+	}
+	// www.douyin.com 的页面需要登录态和签名，移动端分享页直接带数据
+	shareUrl := fmt.Sprintf("https://www.iesdouyin.com/share/%s/%s/", kind, id)
+	page, _, err := fetchPage(ctx, shareUrl, mobileUA, "", auth)
+	if err != nil {
+		return nil, err
+	}
+	item, err := parseDouyinPage(page)
+	if err != nil {
+		return nil, err
+	}
+	return douyinVideoInfo(item, shareUrl), nil
+}
+
+func (d DouyinExtractor) Formats(ctx context.Context, videoUrl string, auth *SiteAuth) ([]models.VideoFormat, error) {
+	info, err := d.Probe(ctx, videoUrl, auth)
+	if err != nil {
+		return nil, err
+	}
+	return info.Formats, nil
+}
+
+// Download 直链有时效，每次下载重新解析
+func (d DouyinExtractor) Download(ctx context.Context, req DownloadRequest) (string, error) {
+	info, err := d.Probe(ctx, req.URL, req.Auth)
+	if err != nil {
+		return "", err
+	}
+	return downloadDirect(ctx, req, info, "https://www.douyin.com/")
+}
+
+// douyinResolve 从链接取出作品类型和 ID，短链先跳转
+func douyinResolve(ctx context.Context, videoUrl string, auth *SiteAuth) (string, string, error) {
+	target := videoUrl
+	if !douyinIDRe.MatchString(target) && !douyinModalRe.MatchString(target) {
+		_, final, err := fetchPage(ctx, videoUrl, mobileUA, "", auth)
+		if err != nil {
+			return "", "", err
+		}
+		target = final.String()
+	}
+	if m := douyinModalRe.FindStringSubmatch(target); m != nil {
+		return "video", m[1], nil
+	}
+	if m := douyinIDRe.FindStringSubmatch(target); m != nil {
+		kind := m[1]
+		if kind == "slides" {
+			kind = "note"
+		}
+		return kind, m[2], nil
+	}
+	return "", "", errors.New("unsupported url: no douyin video id")
+}
+
+// parseDouyinPage 取出页面数据中的第一个作品
+func parseDouyinPage(page string) (*douyinItem, error) {
+	state, err := extractJSONState(page, "window._ROUTER_DATA")
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		LoaderData map[string]json.RawMessage `json:"loaderData"`
+	}
+	if err = json.Unmarshal([]byte(state), &data); err != nil {
+		return nil, err
+	}
+	for key, raw := range data.LoaderData {
+		// video_(id)/page 或 note_(id)/page
+		if !strings.HasSuffix(key, "/page") {
+			continue
+		}
+		var p douyinPage
+		if err = json.Unmarshal(raw, &p); err != nil {
+			return nil, err
+		}
+		if len(p.VideoInfoRes.ItemList) > 0 {
+			return &p.VideoInfoRes.ItemList[0], nil
+		}
+	}
+	return nil, errors.New("douyin video does not exist")
+}
+
+func douyinVideoInfo(item *douyinItem, pageUrl string) *models.VideoInfo {
+	info := &models.VideoInfo{
+		ID:        item.AwemeID,
+		Extractor: "Douyin",
+		Title:     item.Desc,
+		URL:       pageUrl,
+		Duration:  item.Video.Duration / 1000,
+		Thumbnail: item.Video.Cover.first(),
+	}
+	if len(item.Images) > 0 {
+		for _, img := range item.Images {
+			if src := img.first(); src != "" {
+				info.Images = append(info.Images, src)
+			}
+		}
+		if info.Thumbnail == "" && len(info.Images) > 0 {
+			info.Thumbnail = info.Images[0]
+		}
+		return info
+	}
+	if play := item.Video.PlayAddr.first(); play != "" {
+		// playwm 是带水印的地址，去掉 wm 即无水印
+		info.Formats = append(info.Formats, models.VideoFormat{
+			ID:       "play",
+			Ext:      "mp4",
+			Width:    item.Video.Width,
+			Height:   item.Video.Height,
+			VCodec:   "h264",
+			ACodec:   "aac",
+			Protocol: "https",
+			URL:      strings.Replace(play, "/playwm/", "/play/", 1),
+		})
+	}
+	return info
+}
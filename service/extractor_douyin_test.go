@@ -0,0 +1,91 @@
+package service
+
+import (
+	"minodl/models"
+	"reflect"
+	"testing"
+)
+
+func TestParseDouyinPage(t *testing.T) {
+	cases := []struct {
+		fixture string
+		wantID  string
+		wantErr string
+	}{
+		{fixture: "douyin_video.html", wantID: "7301234567890123456"},
+		{fixture: "douyin_note.html", wantID: "7309876543210987654"},
+		{fixture: "douyin_removed.html", wantErr: "douyin video does not exist"},
+		{fixture: "xhs_note.html", wantErr: "page state not found"},
+	}
+	for _, c := range cases {
+		item, err := parseDouyinPage(readFixture(t, c.fixture))
+		if c.wantErr != "" {
+			if err == nil || err.Error() != c.wantErr {
+				t.Errorf("%s: err = %v, want %q", c.fixture, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.fixture, err)
+			continue
+		}
+		if item.AwemeID != c.wantID {
+			t.Errorf("%s: aweme_id = %s, want %s", c.fixture, item.AwemeID, c.wantID)
+		}
+	}
+}
+
+func TestDouyinVideoInfo(t *testing.T) {
+	const pageUrl = "https://www.iesdouyin.com/share/video/7301234567890123456/"
+	cases := []struct {
+		fixture string
+		want    *models.VideoInfo
+	}{
+		{
+			fixture: "douyin_video.html",
+			want: &models.VideoInfo{
+				ID:        "7301234567890123456",
+				Extractor: "Douyin",
+				Title:     "周末去爬山 #户外",
+				URL:       pageUrl,
+				Duration:  15.36,
+				Thumbnail: "https://p3-sign.douyinpic.com/tos-cn-p-0015/cover~noop.jpeg",
+				Formats: []models.VideoFormat{{
+					ID:       "play",
+					Ext:      "mp4",
+					Width:    1080,
+					Height:   1920,
+					VCodec:   "h264",
+					ACodec:   "aac",
+					Protocol: "https",
+					// 去掉水印
+					URL: "https://aweme.snssdk.com/aweme/v1/play/?video_id=v0200fg10000abc&ratio=720p&line=0",
+				}},
+			},
+		},
+		{
+			// 图集没有封面时用第一张图，空的图片跳过
+			fixture: "douyin_note.html",
+			want: &models.VideoInfo{
+				ID:        "7309876543210987654",
+				Extractor: "Douyin",
+				Title:     "今天的早餐",
+				URL:       pageUrl,
+				Thumbnail: "https://p3-sign.douyinpic.com/img1~noop.webp",
+				Images: []string{
+					"https://p3-sign.douyinpic.com/img1~noop.webp",
+					"https://p3-sign.douyinpic.com/img3~noop.webp",
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		item, err := parseDouyinPage(readFixture(t, c.fixture))
+		if err != nil {
+			t.Fatalf("%s: %v", c.fixture, err)
+		}
+		if got := douyinVideoInfo(item, pageUrl); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\n got  %+v\n want %+v", c.fixture, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"minodl/models"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FakeExtractor 不访问网络的后端，返回预设的结果，用于测试和本地联调。
+// 注册后用 RouteExtractors 把测试域名指向它
+type FakeExtractor struct {
+	ExtractorName string
+	Info          *models.VideoInfo
+	Content       []byte // Download 输出的内容
+	Ext           string // 写文件时的扩展名，默认 mp4
+	Err           error  // 非空时所有方法都返回该错误
+	PartialErr    error  // 非空时 Download 输出 Content 后返回该错误，模拟下载到一半失败
+	Caps          Capabilities
+	Hold          chan struct{} // 非空时输出 Content 后等到关闭或 ctx 结束才返回，模拟进行中的下载
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *FakeExtractor) Name() string {
+	if f.ExtractorName == "" {
+		return "fake"
+	}
+	return f.ExtractorName
+}
+
+func (f *FakeExtractor) Capabilities(domain string) Capabilities {
+	return f.Caps
+}
+
+// Calls 按顺序记录的调用，形如 probe:<url>、download:<url>
+func (f *FakeExtractor) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *FakeExtractor) record(call string) {
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.mu.Unlock()
+}
+
+func (f *FakeExtractor) Probe(ctx context.Context, videoUrl string, auth *SiteAuth) (*models.VideoInfo, error) {
+	f.record("probe:" + videoUrl)
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if f.Info == nil {
+		return nil, errors.New("fake extractor has no info")
+	}
+	info := *f.Info
+	return &info, nil
+}
+
+func (f *FakeExtractor) Formats(ctx context.Context, videoUrl string, auth *SiteAuth) ([]models.VideoFormat, error) {
+	info, err := f.Probe(ctx, videoUrl, auth)
+	if err != nil {
+		return nil, err
+	}
+	return info.Formats, nil
+}
+
+func (f *FakeExtractor) Download(ctx context.Context, req DownloadRequest) (string, error) {
+	f.record("download:" + req.URL)
+	if f.Err != nil {
+		return "", f.Err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	total := int64(len(f.Content))
+	if req.Writer != nil {
+		if _, err := io.Copy(req.Writer, bytes.NewReader(f.Content)); err != nil {
+			return "", err
+		}
+		if f.PartialErr != nil {
+			return "", f.PartialErr
+		}
+		if req.Tracker != nil {
+			req.Tracker.Progress(progressSample{status: "downloading", downloaded: total})
+		}
+		return "", f.hold(ctx)
+	}
+	ext := f.Ext
+	if ext == "" {
+		ext = "mp4"
+	}
+	if err := os.MkdirAll(req.Dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	file := filepath.Join(req.Dir, req.Name+"."+ext)
+	if err := os.WriteFile(file, f.Content, 0o644); err != nil {
+		return "", err
+	}
+	if f.PartialErr != nil {
+		return "", f.PartialErr
+	}
+	if err := f.hold(ctx); err != nil {
+		return "", err
+	}
+	if req.Tracker != nil {
+		req.Tracker.Progress(progressSample{status: "finished", downloaded: total, total: total})
+	}
+	return file, nil
+}
+
+func (f *FakeExtractor) hold(ctx context.Context) error {
+	if f.Hold == nil {
+		return nil
+	}
+	select {
+	case <-f.Hold:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
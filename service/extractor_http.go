@@ -0,0 +1,245 @@
+package service
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"minodl/models"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 原生后端共用的页面抓取和直链下载
+
+const (
+	mobileUA         = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1"
+	desktopUA        = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36"
+	pageFetchTimeout = 20 * time.Second
+	maxPageBytes     = 8 << 20
+)
+
+var (
+	pageClient  = &http.Client{Timeout: pageFetchTimeout}
+	mediaClient = &http.Client{} // 下载时长由 ctx 控制
+
+	specHeightRe = regexp.MustCompile(`height<=\??(\d+)`)
+)
+
+// fetchPage 抓取分享页，返回页面内容和跳转后的地址；有登录信息时带上对应的 cookie
+func fetchPage(ctx context.Context, pageUrl, ua, referer string, auth *SiteAuth) (string, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageUrl, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("User-Agent", ua)
+	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+	if cookie := auth.cookieHeader(req.URL.Hostname()); cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	resp, err := pageClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("HTTP Error %d: %s", resp.StatusCode, pageUrl)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPageBytes))
+	if err != nil {
+		return "", nil, err
+	}
+	return string(body), resp.Request.URL, nil
+}
+
+// extractJSONState 取出页面中 `marker = {...}</script>` 形式的初始数据
+func extractJSONState(page, marker string) (string, error) {
+	i := strings.Index(page, marker)
+	if i < 0 {
+		return "", errors.New("page state not found")
+	}
+	rest := strings.TrimLeft(page[i+len(marker):], " \t=")
+	end := strings.Index(rest, "</script>")
+	if end < 0 {
+		return "", errors.New("page state not terminated")
+	}
+	return strings.TrimRight(strings.TrimSpace(rest[:end]), ";"), nil
+}
+
+// pickFormat 按 yt-dlp 格式表达式近似选择：依次匹配 format_id 或 height<=N，否则取后端排在第一的格式。
+// 有清晰度上限但没有符合的格式时取最低的，不超出套餐限制
+func pickFormat(formats []models.VideoFormat, spec string) (models.VideoFormat, error) {
+	if len(formats) == 0 {
+		return models.VideoFormat{}, errors.New("requested format is not available")
+	}
+	sorted := append([]models.VideoFormat(nil), formats...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Height > sorted[j].Height })
+	limited := false
+	for _, alt := range strings.Split(spec, "/") {
+		id, _, _ := strings.Cut(alt, "+")
+		for _, f := range sorted {
+			if f.ID == id {
+				return f, nil
+			}
+		}
+		if m := specHeightRe.FindStringSubmatch(alt); m != nil {
+			limited = true
+			limit, _ := strconv.Atoi(m[1])
+			for _, f := range sorted {
+				if f.Height <= limit {
+					return f, nil
+				}
+			}
+		}
+	}
+	if limited {
+		return sorted[len(sorted)-1], nil
+	}
+	return formats[0], nil
+}
+
+// downloadDirect 下载解析出的直链：视频取一个格式，图集打包成 zip
+func downloadDirect(ctx context.Context, req DownloadRequest, info *models.VideoInfo, referer string) (string, error) {
+	if len(info.Formats) == 0 && len(info.Images) > 0 {
+		if req.Writer != nil {
+			return "", errors.New("image post cannot be streamed")
+		}
+		return downloadGallery(ctx, req, info.Images, referer)
+	}
+	f, err := pickFormat(info.Formats, req.FormatSpec)
+	if err != nil {
+		return "", err
+	}
+	if req.Writer != nil {
+		return "", fetchMedia(ctx, f.URL, referer, req.Writer, req.Tracker)
+	}
+	ext := f.Ext
+	if ext == "" {
+		ext = "mp4"
+	}
+	file := filepath.Join(req.Dir, req.Name+"."+ext)
+	out, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	if err = fetchMedia(ctx, f.URL, referer, out, req.Tracker); err != nil {
+		_ = out.Close()
+		return "", err
+	}
+	return file, out.Close()
+}
+
+func downloadGallery(ctx context.Context, req DownloadRequest, images []string, referer string) (string, error) {
+	file := filepath.Join(req.Dir, req.Name+".zip")
+	out, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	counter := &countingWriter{}
+	for i, src := range images {
+		// 图片本身已压缩，不再压缩
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%02d%s", i+1, imageExt(src)), Method: zip.Store})
+		if err != nil {
+			return "", err
+		}
+		counter.w = w
+		if err = fetchMedia(ctx, src, referer, counter, nil); err != nil {
+			return "", err
+		}
+		// 总大小按已下载图片的平均大小估算
+		if req.Tracker != nil {
+			req.Tracker.Progress(progressSample{
+				status:     "downloading",
+				downloaded: counter.n,
+				total:      counter.n / int64(i+1) * int64(len(images)),
+			})
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return "", err
+	}
+	return file, out.Close()
+}
+
+func imageExt(src string) string {
+	if u, err := url.Parse(src); err == nil {
+		switch ext := strings.ToLower(filepath.Ext(u.Path)); ext {
+		case ".jpg", ".jpeg", ".png", ".webp", ".gif", ".heic":
+			return ext
+		}
+	}
+	return ".jpg"
+}
+
+// fetchMedia 下载直链写入 w，tracker 非空时每秒更新进度
+func fetchMedia(ctx context.Context, src, referer string, w io.Writer, tracker *TaskTracker) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", desktopUA)
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP Error %d: unable to download video data", resp.StatusCode)
+	}
+	if tracker == nil {
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	p := &progressWriter{w: w, tracker: tracker, start: time.Now(), sample: progressSample{status: "downloading"}}
+	if resp.ContentLength > 0 {
+		p.sample.total = resp.ContentLength
+	}
+	if _, err = io.Copy(p, resp.Body); err != nil {
+		return err
+	}
+	p.sample.status = "finished"
+	p.sample.total = p.sample.downloaded
+	tracker.Progress(p.sample)
+	return nil
+}
+
+// progressWriter 按写入字节数换算进度，和 yt-dlp 的进度输出一致
+type progressWriter struct {
+	w       io.Writer
+	tracker *TaskTracker
+	start   time.Time
+	last    time.Time
+	sample  progressSample
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.sample.downloaded += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+			p.sample.speed = float64(p.sample.downloaded) / elapsed
+		}
+		if p.sample.total > 0 && p.sample.speed > 0 {
+			p.sample.eta = int(float64(p.sample.total-p.sample.downloaded) / p.sample.speed)
+		}
+		p.tracker.Progress(p.sample)
+	}
+	return n, err
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"minodl/models"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readFixture 读取 testdata 下保存的页面
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestExtractJSONState(t *testing.T) {
+	cases := []struct {
+		page    string
+		want    string
+		wantErr bool
+	}{
+		{`<script>window.S = {"a":1};</script>`, `{"a":1}`, false},
+		{`<script>window.S={"a":1}</script>`, `{"a":1}`, false},
+		{"<script>window.S =\n  {\"a\":1};\n</script>", `{"a":1}`, false},
+		{`<script>window.T = {}</script>`, "", true},
+		{`<script>window.S = {"a":1}`, "", true},
+	}
+	for _, c := range cases {
+		got, err := extractJSONState(c.page, "window.S")
+		if (err != nil) != c.wantErr || got != c.want {
+			t.Errorf("extractJSONState(%q) = %q, %v, want %q", c.page, got, err, c.want)
+		}
+	}
+}
+
+func TestPickFormat(t *testing.T) {
+	formats := []models.VideoFormat{
+		{ID: "480", Height: 480},
+		{ID: "1080", Height: 1080},
+		{ID: "origin"},
+		{ID: "720", Height: 720},
+	}
+	cases := []struct {
+		name string
+		spec string
+		want string
+	}{
+		{"no spec takes the backend's first", "", "480"},
+		{"best takes the backend's first", "best", "480"},
+		{"format id", "720", "720"},
+		{"merged id uses the video part", "720+140", "720"},
+		{"id falls through to the next alternative", "137+140/1080", "1080"},
+		{"height limit", "best[height<=720]", "720"},
+		{"optional height limit", "bv*[height<=?1000]+ba/b[height<=?1000]", "720"},
+		{"height limit above all", "best[height<=2160]", "1080"},
+		{"nothing under the limit takes the lowest", "best[height<=360]", "origin"},
+		{"unknown id", "137", "480"},
+	}
+	for _, c := range cases {
+		got, err := pickFormat(formats, c.spec)
+		if err != nil {
+			t.Errorf("%s: pickFormat(%q): %v", c.name, c.spec, err)
+			continue
+		}
+		if got.ID != c.want {
+			t.Errorf("%s: pickFormat(%q) = %s, want %s", c.name, c.spec, got.ID, c.want)
+		}
+	}
+	if _, err := pickFormat(nil, "best"); err == nil {
+		t.Error("pickFormat with no formats succeeded")
+	}
+}
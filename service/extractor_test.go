@@ -0,0 +1,184 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"minodl/models"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withExtractors 测试期间只使用给定的后端和路由
+func withExtractors(t *testing.T, routes map[string][]string, list ...Extractor) {
+	t.Helper()
+	extractors.Lock()
+	byName, saved, chain := extractors.byName, extractors.routes, extractors.defaultChain
+	extractors.byName = make(map[string]Extractor)
+	extractors.routes = make(map[string][]string)
+	extractors.defaultChain = nil
+	extractors.Unlock()
+	t.Cleanup(func() {
+		extractors.Lock()
+		extractors.byName, extractors.routes, extractors.defaultChain = byName, saved, chain
+		extractors.Unlock()
+	})
+	for _, e := range list {
+		RegisterExtractor(e)
+	}
+	for domain, names := range routes {
+		RouteExtractors(domain, names...)
+	}
+}
+
+func extractorNames(list []Extractor) []string {
+	out := []string{}
+	for _, e := range list {
+		out = append(out, e.Name())
+	}
+	return out
+}
+
+func TestExtractorsForRoutes(t *testing.T) {
+	withExtractors(t, map[string][]string{
+		"example.com":     {"a", "b"},
+		"sub.example.com": {"b"},
+		"other.com":       {"missing", "a"},
+	},
+		&FakeExtractor{ExtractorName: "a"},
+		&FakeExtractor{ExtractorName: "b"},
+		&FakeExtractor{ExtractorName: "c"},
+	)
+	extractors.Lock()
+	extractors.defaultChain = []string{"c"}
+	extractors.Unlock()
+
+	cases := []struct {
+		url  string
+		want []string
+	}{
+		{"https://example.com/v/1", []string{"a", "b"}},
+		{"https://www.EXAMPLE.com/v/1", []string{"a", "b"}},
+		{"https://sub.example.com/v/1", []string{"b"}},
+		{"https://deep.sub.example.com/v/1", []string{"b"}},
+		{"https://notexample.com/v/1", []string{"c"}},
+		{"https://other.com/v/1", []string{"a"}},
+		{"https://unknown.org/v/1", []string{"c"}},
+		{"not a url", []string{"c"}},
+	}
+	for _, c := range cases {
+		if got := extractorNames(ExtractorsFor(c.url)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ExtractorsFor(%q) = %v, want %v", c.url, got, c.want)
+		}
+	}
+}
+
+func TestProbeVideoFallback(t *testing.T) {
+	info := &models.VideoInfo{ID: "v1", Title: "second", Formats: []models.VideoFormat{{ID: "18", Ext: "mp4", Height: 360}}}
+	first := &FakeExtractor{ExtractorName: "first", Err: errors.New("page changed")}
+	second := &FakeExtractor{ExtractorName: "second", Info: info}
+	withExtractors(t, map[string][]string{"fake.test": {"first", "second"}}, first, second)
+
+	got, err := probeVideo(context.Background(), "https://fake.test/v/1", nil)
+	if err != nil {
+		t.Fatalf("probeVideo: %v", err)
+	}
+	if got.Title != "second" {
+		t.Fatalf("probeVideo used %q, want the second extractor", got.Title)
+	}
+	if calls := first.Calls(); !reflect.DeepEqual(calls, []string{"probe:https://fake.test/v/1"}) {
+		t.Errorf("first extractor calls = %v", calls)
+	}
+	formats, err := ExtractorsFor("https://fake.test/v/1")[1].Formats(context.Background(), "https://fake.test/v/1", nil)
+	if err != nil || !reflect.DeepEqual(formats, info.Formats) {
+		t.Errorf("Formats = %v, %v, want %v", formats, err, info.Formats)
+	}
+
+	second.Err = errors.New("gone too")
+	if _, err = probeVideo(context.Background(), "https://fake.test/v/1", nil); err != second.Err {
+		t.Errorf("all extractors failed: err = %v, want the last error", err)
+	}
+
+	// 调用方已经放弃时不再尝试下一个
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := len(second.Calls())
+	if _, err = probeVideo(ctx, "https://fake.test/v/1", nil); err == nil {
+		t.Error("probeVideo succeeded with a cancelled context")
+	}
+	if len(second.Calls()) != before {
+		t.Error("probeVideo fell back after the context was cancelled")
+	}
+}
+
+func TestProbeVideoNoExtractor(t *testing.T) {
+	withExtractors(t, nil)
+	if _, err := probeVideo(context.Background(), "https://fake.test/v/1", nil); !errors.Is(err, ErrNoExtractor) {
+		t.Errorf("err = %v, want ErrNoExtractor", err)
+	}
+}
+
+func TestDownloadVideoFileFallback(t *testing.T) {
+	// 第一个后端写了一半失败，换下一个前删掉残留的文件
+	first := &FakeExtractor{ExtractorName: "first", Content: []byte("partial"), Ext: "webm", PartialErr: errors.New("connection reset")}
+	second := &FakeExtractor{ExtractorName: "second", Content: []byte("complete video")}
+	withExtractors(t, map[string][]string{"fake.test": {"first", "second"}}, first, second)
+	dir := t.TempDir()
+
+	file, err := downloadVideo(context.Background(), DownloadRequest{URL: "https://fake.test/v/1", Dir: dir, Name: "42"})
+	if err != nil {
+		t.Fatalf("downloadVideo: %v", err)
+	}
+	if file != filepath.Join(dir, "42.mp4") {
+		t.Errorf("file = %s, want 42.mp4 from the second extractor", file)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "complete video" {
+		t.Errorf("content = %q", data)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "42.webm")); !os.IsNotExist(err) {
+		t.Errorf("partial file of the failed extractor was kept: %v", err)
+	}
+}
+
+func TestDownloadVideoStreamFallback(t *testing.T) {
+	cases := []struct {
+		name       string
+		first      *FakeExtractor
+		wantOutput string
+		wantErr    bool
+		wantSecond bool
+	}{
+		{
+			name:       "fails before output",
+			first:      &FakeExtractor{ExtractorName: "first", Err: errors.New("page changed")},
+			wantOutput: "second",
+			wantSecond: true,
+		},
+		{
+			// 已经输出的数据不能和下一个后端的拼在一起
+			name:       "fails after output",
+			first:      &FakeExtractor{ExtractorName: "first", Content: []byte("first"), PartialErr: errors.New("connection reset")},
+			wantOutput: "first",
+			wantErr:    true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			second := &FakeExtractor{ExtractorName: "second", Content: []byte("second")}
+			withExtractors(t, map[string][]string{"fake.test": {"first", "second"}}, c.first, second)
+			var out bytes.Buffer
+			_, err := downloadVideo(context.Background(), DownloadRequest{URL: "https://fake.test/v/1", Writer: &out})
+			if (err != nil) != c.wantErr {
+				t.Fatalf("err = %v, want error %v", err, c.wantErr)
+			}
+			if out.String() != c.wantOutput {
+				t.Errorf("output = %q, want %q", out.String(), c.wantOutput)
+			}
+			if called := len(second.Calls()) > 0; called != c.wantSecond {
+				t.Errorf("second extractor called = %v, want %v", called, c.wantSecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"minodl/models"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const ExtractorXHS = "xiaohongshu"
+
+var (
+	xhsNoteIDRe    = regexp.MustCompile(`/(?:explore|discovery/item|item)/([0-9a-f]{24})`)
+	xhsUndefinedRe = regexp.MustCompile(`([:\[,])\s*undefined\b`)
+)
+
+// XHSExtractor 解析笔记页 window.__INITIAL_STATE__，支持视频和图文笔记
+type XHSExtractor struct{}
+
+type xhsNote struct {
+	NoteID    string `json:"noteId"`
+	Type      string `json:"type"` // video | normal
+	Title     string `json:"title"`
+	Desc      string `json:"desc"`
+	ImageList []struct {
+		URLDefault string `json:"urlDefault"`
+		Width      int    `json:"width"`
+		Height     int    `json:"height"`
+	} `json:"imageList"`
+	Video struct {
+		Consumer struct {
+			OriginVideoKey string `json:"originVideoKey"`
+		} `json:"consumer"`
+		Media struct {
+			Video struct {
+				Duration float64 `json:"duration"` // 秒
+			} `json:"video"`
+			Stream map[string][]xhsStream `json:"stream"` // h264 | h265 | av1
+		} `json:"media"`
+	} `json:"video"`
+}
+
+type xhsStream struct {
+	MasterURL  string `json:"masterUrl"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Size       int64  `json:"size"`
+	AvgBitrate int    `json:"avgBitrate"` // bit/s
+	VideoCodec string `json:"videoCodec"`
+	Format     string `json:"format"`
+}
+
+func (XHSExtractor) Name() string { return ExtractorXHS }
+
+// Capabilities 原片清晰度取决于上传者，没有固定上限
+func (XHSExtractor) Capabilities(domain string) Capabilities {
+	return Capabilities{Images: true}
+}
+
+func (XHSExtractor) Probe(ctx context.Context, videoUrl string, auth *SiteAuth) (*models.VideoInfo, error) {
+	// 分享短链跳转到笔记页，链接里的 xsec_token 需要保留
+	page, final, err := fetchPage(ctx, videoUrl, desktopUA, "https://www.xiaohongshu.com/", auth)
+	if err != nil {
+		return nil, err
+	}
+	note, err := parseXHSPage(page, final.String())
+	if err != nil {
+		return nil, err
+	}
+	return xhsVideoInfo(note, final.String()), nil
+}
+
+func (x XHSExtractor) Formats(ctx context.Context, videoUrl string, auth *SiteAuth) ([]models.VideoFormat, error) {
+	info, err := x.Probe(ctx, videoUrl, auth)
+	if err != nil {
+		return nil, err
+	}
+	return info.Formats, nil
+}
+
+func (x XHSExtractor) Download(ctx context.Context, req DownloadRequest) (string, error) {
+	info, err := x.Probe(ctx, req.URL, req.Auth)
+	if err != nil {
+		return "", err
+	}
+	return downloadDirect(ctx, req, info, "https://www.xiaohongshu.com/")
+}
+
+// parseXHSPage 按地址中的笔记 ID 取出笔记，没有 ID 时取页面的第一条
+func parseXHSPage(page, pageUrl string) (*xhsNote, error) {
+	state, err := extractJSONState(page, "window.__INITIAL_STATE__")
+	if err != nil {
+		return nil, err
+	}
+	// 页面数据是 JS 对象字面量，undefined 不是合法 JSON
+	state = xhsUndefinedRe.ReplaceAllString(state, "${1}null")
+	var data struct {
+		Note struct {
+			FirstNoteID   string `json:"firstNoteId"`
+			NoteDetailMap map[string]struct {
+				Note xhsNote `json:"note"`
+			} `json:"noteDetailMap"`
+		} `json:"note"`
+	}
+	if err = json.Unmarshal([]byte(state), &data); err != nil {
+		return nil, err
+	}
+	id := data.Note.FirstNoteID
+	if m := xhsNoteIDRe.FindStringSubmatch(pageUrl); m != nil {
+		id = m[1]
+	}
+	if d, ok := data.Note.NoteDetailMap[id]; ok && d.Note.NoteID != "" {
+		return &d.Note, nil
+	}
+	// 笔记被删除或需要登录时页面里没有数据
+	return nil, errors.New("xiaohongshu note does not exist or requires login")
+}
+
+func xhsVideoInfo(note *xhsNote, pageUrl string) *models.VideoInfo {
+	title := note.Title
+	if title == "" {
+		title = note.Desc
+	}
+	info := &models.VideoInfo{
+		ID:        note.NoteID,
+		Extractor: "XiaoHongShu",
+		Title:     title,
+		URL:       pageUrl,
+		Duration:  note.Video.Media.Video.Duration,
+	}
+	for _, img := range note.ImageList {
+		if img.URLDefault != "" {
+			info.Images = append(info.Images, img.URLDefault)
+		}
+	}
+	if len(info.Images) > 0 {
+		info.Thumbnail = info.Images[0]
+	}
+	if note.Type != "video" {
+		return info
+	}
+	// 视频笔记的图片只是封面
+	info.Images = nil
+	if key := note.Video.Consumer.OriginVideoKey; key != "" {
+		// 原始上传的文件，不带水印
+		info.Formats = append(info.Formats, models.VideoFormat{
+			ID:         "origin",
+			Ext:        "mp4",
+			FormatNote: "original",
+			Protocol:   "https",
+			VCodec:     "h264",
+			ACodec:     "aac",
+			URL:        "https://sns-video-bd.xhscdn.com/" + key,
+		})
+	}
+	// 按编码排序，缓存和重新解析的结果顺序一致；同一编码可能有多路同样高度的流，ID 带上序号
+	for _, codec := range slices.Sorted(maps.Keys(note.Video.Media.Stream)) {
+		for i, s := range note.Video.Media.Stream[codec] {
+			if s.MasterURL == "" {
+				continue
+			}
+			ext := s.Format
+			if ext == "" {
+				ext = "mp4"
+			}
+			info.Formats = append(info.Formats, models.VideoFormat{
+				ID:       codec + "-" + heightLabel(s.Height) + "-" + strconv.Itoa(i),
+				Ext:      ext,
+				Width:    s.Width,
+				Height:   s.Height,
+				VCodec:   strings.ToLower(s.VideoCodec),
+				ACodec:   "aac",
+				Protocol: "https",
+				TBR:      float64(s.AvgBitrate) / 1000,
+				Size:     s.Size,
+				URL:      s.MasterURL,
+			})
+		}
+	}
+	return info
+}
+
+func heightLabel(h int) string {
+	if h <= 0 {
+		return "src"
+	}
+	return strconv.Itoa(h) + "p"
+}
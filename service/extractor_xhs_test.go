@@ -0,0 +1,169 @@
+package service
+
+import (
+	"minodl/models"
+	"reflect"
+	"testing"
+)
+
+func TestParseXHSPage(t *testing.T) {
+	cases := []struct {
+		name    string
+		fixture string
+		pageUrl string
+		wantID  string
+		wantErr string
+	}{
+		{
+			name:    "first note",
+			fixture: "xhs_video.html",
+			pageUrl: "https://www.xiaohongshu.com/discovery/item/65a1b2c3d4e5f60718293a4b?xsec_token=abc",
+			wantID:  "65a1b2c3d4e5f60718293a4b",
+		},
+		{
+			// 地址中的 ID 优先于 firstNoteId
+			name:    "id from url",
+			fixture: "xhs_note.html",
+			pageUrl: "https://www.xiaohongshu.com/explore/6601a2b3c4d5e6f708192a3b?xsec_token=abc",
+			wantID:  "6601a2b3c4d5e6f708192a3b",
+		},
+		{
+			name:    "no id in url",
+			fixture: "xhs_note.html",
+			pageUrl: "https://www.xiaohongshu.com/user/profile/5f00",
+			wantID:  "65ffffffffffffffffffffff",
+		},
+		{
+			name:    "note not in page",
+			fixture: "xhs_note.html",
+			pageUrl: "https://www.xiaohongshu.com/explore/660000000000000000000000",
+			wantErr: "xiaohongshu note does not exist or requires login",
+		},
+		{
+			name:    "login wall",
+			fixture: "xhs_login.html",
+			pageUrl: "https://www.xiaohongshu.com/explore/6601a2b3c4d5e6f708192a3b",
+			wantErr: "xiaohongshu note does not exist or requires login",
+		},
+		{
+			name:    "other site",
+			fixture: "douyin_video.html",
+			pageUrl: "https://www.xiaohongshu.com/explore/6601a2b3c4d5e6f708192a3b",
+			wantErr: "page state not found",
+		},
+	}
+	for _, c := range cases {
+		note, err := parseXHSPage(readFixture(t, c.fixture), c.pageUrl)
+		if c.wantErr != "" {
+			if err == nil || err.Error() != c.wantErr {
+				t.Errorf("%s: err = %v, want %q", c.name, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if note.NoteID != c.wantID {
+			t.Errorf("%s: noteId = %s, want %s", c.name, note.NoteID, c.wantID)
+		}
+	}
+}
+
+func TestXHSVideoInfo(t *testing.T) {
+	cases := []struct {
+		fixture string
+		pageUrl string
+		want    *models.VideoInfo
+	}{
+		{
+			// 标题为空时用正文，视频笔记的图片只作封面
+			fixture: "xhs_video.html",
+			pageUrl: "https://www.xiaohongshu.com/explore/65a1b2c3d4e5f60718293a4b",
+			want: &models.VideoInfo{
+				ID:        "65a1b2c3d4e5f60718293a4b",
+				Extractor: "XiaoHongShu",
+				Title:     "十分钟学会手冲咖啡",
+				URL:       "https://www.xiaohongshu.com/explore/65a1b2c3d4e5f60718293a4b",
+				Duration:  92,
+				Thumbnail: "http://sns-webpic-qc.xhscdn.com/cover/1040g2sg30",
+				Formats: []models.VideoFormat{
+					{
+						ID:         "origin",
+						Ext:        "mp4",
+						FormatNote: "original",
+						Protocol:   "https",
+						VCodec:     "h264",
+						ACodec:     "aac",
+						URL:        "https://sns-video-bd.xhscdn.com/pre_post/1040g2t031abc",
+					},
+					{
+						ID:       "h264-1440p-0",
+						Ext:      "mp4",
+						Width:    1080,
+						Height:   1440,
+						VCodec:   "h264",
+						ACodec:   "aac",
+						Protocol: "https",
+						TBR:      1324.5,
+						Size:     15234567,
+						URL:      "http://sns-video-qc.xhscdn.com/stream/110/258/01e5abc_258.mp4",
+					},
+				},
+			},
+		},
+		{
+			fixture: "xhs_note.html",
+			pageUrl: "https://www.xiaohongshu.com/explore/6601a2b3c4d5e6f708192a3b",
+			want: &models.VideoInfo{
+				ID:        "6601a2b3c4d5e6f708192a3b",
+				Extractor: "XiaoHongShu",
+				Title:     "杭州三日游",
+				URL:       "https://www.xiaohongshu.com/explore/6601a2b3c4d5e6f708192a3b",
+				Thumbnail: "http://sns-webpic-qc.xhscdn.com/spectrum/1040g0k030a",
+				Images: []string{
+					"http://sns-webpic-qc.xhscdn.com/spectrum/1040g0k030a",
+					"http://sns-webpic-qc.xhscdn.com/spectrum/1040g0k030b",
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		note, err := parseXHSPage(readFixture(t, c.fixture), c.pageUrl)
+		if err != nil {
+			t.Fatalf("%s: %v", c.fixture, err)
+		}
+		if got := xhsVideoInfo(note, c.pageUrl); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\n got  %+v\n want %+v", c.fixture, got, c.want)
+		}
+	}
+}
+
+// 同一编码同样高度的多路流 ID 不重复，编码按名称排序，多次解析顺序一致
+func TestXHSStreamFormats(t *testing.T) {
+	note := &xhsNote{NoteID: "n", Type: "video"}
+	note.Video.Media.Stream = map[string][]xhsStream{
+		"h265": {
+			{MasterURL: "https://cdn/h265-a.mp4", Width: 720, Height: 960, AvgBitrate: 900000, VideoCodec: "HEVC"},
+			{MasterURL: ""},
+			{MasterURL: "https://cdn/h265-b.mp4", Width: 720, Height: 960, AvgBitrate: 600000, VideoCodec: "HEVC"},
+		},
+		"av1":  {{MasterURL: "https://cdn/av1.webm", VideoCodec: "AV1", Format: "webm"}},
+		"h264": {{MasterURL: "https://cdn/h264.mp4", Width: 720, Height: 960, VideoCodec: "H264"}},
+	}
+	want := []models.VideoFormat{
+		{ID: "av1-src-0", Ext: "webm", VCodec: "av1", ACodec: "aac", Protocol: "https", URL: "https://cdn/av1.webm"},
+		{ID: "h264-960p-0", Ext: "mp4", Width: 720, Height: 960, VCodec: "h264", ACodec: "aac", Protocol: "https", URL: "https://cdn/h264.mp4"},
+		{ID: "h265-960p-0", Ext: "mp4", Width: 720, Height: 960, VCodec: "hevc", ACodec: "aac", Protocol: "https", TBR: 900, URL: "https://cdn/h265-a.mp4"},
+		{ID: "h265-960p-2", Ext: "mp4", Width: 720, Height: 960, VCodec: "hevc", ACodec: "aac", Protocol: "https", TBR: 600, URL: "https://cdn/h265-b.mp4"},
+	}
+	for i := 0; i < 10; i++ {
+		if got := xhsVideoInfo(note, "").Formats; !reflect.DeepEqual(got, want) {
+			t.Fatalf("formats = %+v, want %+v", got, want)
+		}
+	}
+	f, err := pickFormat(want, "h265-960p-2")
+	if err != nil || f.URL != "https://cdn/h265-b.mp4" {
+		t.Errorf("pickFormat by id = %+v, %v", f, err)
+	}
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"errors"
+	"math/rand"
+	"os/exec"
+	"regexp"
+	"time"
+)
+
+// 失败原因，保存在 Task.ErrorCode，客户端按 code 提示
+const (
+	FailGeoBlocked     = "geo_blocked"
+	FailLoginRequired  = "login_required"
+	FailCookiesExpired = "cookies_expired" // 用户保存的登录信息已失效，需要重新上传
+	FailRemoved        = "removed"
+	FailRateLimited    = "rate_limited"
+	FailNetwork        = "network"
+	FailUnsupported    = "unsupported"
+	FailStorage        = "storage"
+	FailQuota          = "quota_exceeded" // 本月流量已用完
+	FailUnknown        = "unknown"
+
+	maxAttempts      = 3
+	retryBaseDelay   = 30 * time.Second
+	rateLimitedDelay = 2 * time.Minute
+	maxRetryDelay    = 30 * time.Minute
+)
+
+// 按顺序匹配，越具体的放越前面
+var failurePatterns = []struct {
+	code string
+	re   *regexp.Regexp
+}{
+	{FailGeoBlocked, regexp.MustCompile(`(?i)available in your (country|location)|geo[- ]?restrict|blocked it in your country`)},
+	{FailLoginRequired, regexp.MustCompile(`(?i)sign in to confirm|login required|\blog ?in to\b|\bplease log ?in\b|requires authentication|members[- ]only|private video|confirm your age|age[- ]restricted|use --cookies|account cookies`)},
+	{FailRateLimited, regexp.MustCompile(`(?i)http error 429|too many requests|rate[- ]limit`)},
+	{FailRemoved, regexp.MustCompile(`(?i)video unavailable|has been removed|been terminated|no longer available|does not exist|http error 404|video (is )?not found`)},
+	{FailUnsupported, regexp.MustCompile(`(?i)unsupported url|no suitable infoextractor|requested format is not available|is not a valid url`)},
+	{FailNetwork, regexp.MustCompile(`(?i)timed out|connection (reset|refused|aborted)|temporary failure in name resolution|network is unreachable|unable to download (webpage|video data)|incompleteread|http error 5\d\d|ssl: |eof occurred`)},
+}
+
+// ClassifyFailure 根据 yt-dlp 的 stderr 和退出码归类失败原因
+func ClassifyFailure(output string, err error) string {
+	for _, p := range failurePatterns {
+		if p.re.MatchString(output) {
+			return p.code
+		}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// yt-dlp 退出码 2 表示参数错误
+		if exitErr.ExitCode() == 2 {
+			return FailUnsupported
+		}
+	}
+	return FailUnknown
+}
+
+// IsTransient 网络和限流错误可以自动重试
+func IsTransient(code string) bool {
+	return code == FailNetwork || code == FailRateLimited
+}
+
+// retryDelay 指数退避加随机抖动
+func retryDelay(code string, attempt int) time.Duration {
+	base := retryBaseDelay
+	if code == FailRateLimited {
+		base = rateLimitedDelay
+	}
+	delay := base << uint(attempt-1)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/4)+1))
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	cases := []struct {
+		output string
+		want   string
+	}{
+		{"ERROR: [youtube] abc: Sign in to confirm you're not a bot", FailLoginRequired},
+		{"ERROR: [instagram] abc: You need to log in to access this content", FailLoginRequired},
+		{"ERROR: [bilibili] abc: Please login to view. Please log in", FailLoginRequired},
+		{"ERROR: [twitter] abc: login to view this content; Login required", FailLoginRequired},
+		{"ERROR: [youtube] abc: Private video", FailLoginRequired},
+		{"ERROR: [youtube] abc: This video is age-restricted", FailLoginRequired},
+		{"ERROR: [youtube] abc: The uploader has not made this video available in your country", FailGeoBlocked},
+		{"ERROR: unable to download video data: HTTP Error 429: Too Many Requests", FailRateLimited},
+		{"ERROR: [youtube] abc: Video unavailable", FailRemoved},
+		{"ERROR: unable to download webpage: HTTP Error 404: Not Found", FailRemoved},
+		{"ERROR: Unsupported URL: https://example.com/", FailUnsupported},
+		{"ERROR: Requested format is not available", FailUnsupported},
+		{"ERROR: unable to download webpage: <urlopen error timed out>", FailNetwork},
+		{"ERROR: unable to download video data: HTTP Error 503: Service Unavailable", FailNetwork},
+		// 包含 log in 的普通词不应判为需要登录
+		{"ERROR: [generic] abc: unable to download webpage: blog index timed out", FailNetwork},
+		{"[download] Destination: catalog in progress", FailUnknown},
+		{"ERROR: [generic] abc: dialog initialization failed", FailUnknown},
+		{"", FailUnknown},
+	}
+	for _, c := range cases {
+		if got := ClassifyFailure(c.output, errors.New(c.output)); got != c.want {
+			t.Errorf("ClassifyFailure(%q) = %s, want %s", c.output, got, c.want)
+		}
+	}
+}
+
+func TestClassifyFailureExitCode(t *testing.T) {
+	err := exec.Command("sh", "-c", "exit 2").Run()
+	if got := ClassifyFailure("yt-dlp: error: no such option: --bogus", err); got != FailUnsupported {
+		t.Errorf("exit code 2 = %s, want %s", got, FailUnsupported)
+	}
+	err = exec.Command("sh", "-c", "exit 1").Run()
+	if got := ClassifyFailure("something odd", err); got != FailUnknown {
+		t.Errorf("exit code 1 = %s, want %s", got, FailUnknown)
+	}
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"minodl/models"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultFormatSpec = "best[ext=mp4]/best"
+	audioFormatSpec   = "ba[ext=m4a]/ba/b"
+	FormatBest        = "best"
+	FormatAudio       = "audio"
+)
+
+var (
+	qualityLabelRe = regexp.MustCompile(`^(\d{3,4})p(\d{2})?$`)
+
+	ErrPlanQuality = errors.New("quality not available on your plan")
+)
+
+// 各套餐可下载的最高清晰度（高度），0 表示不限
+var planMaxHeight = map[string]int{
+	models.PlanFree:  1080,
+	models.PlanPro:   2160,
+	models.PlanUltra: 0,
+}
+
+// PlanMaxHeight 未知套餐按免费套餐处理
+func PlanMaxHeight(plan string) int {
+	if h, ok := planMaxHeight[plan]; ok {
+		return h
+	}
+	return planMaxHeight[models.PlanFree]
+}
+
+// buildQualities 把 yt-dlp formats 整理成可选清晰度，同一清晰度只保留最合适的一个
+func buildQualities(formats []models.VideoFormat) []models.Quality {
+	var bestAudio *models.VideoFormat
+	for i := range formats {
+		f := &formats[i]
+		if f.VCodec == "none" && f.ACodec != "none" && (bestAudio == nil || f.ABR > bestAudio.ABR) {
+			bestAudio = f
+		}
+	}
+	videos := make(map[string]models.Quality)
+	audios := make(map[string]models.Quality)
+	for _, f := range formats {
+		if f.Protocol == "mhtml" || (f.VCodec == "none" && f.ACodec == "none") {
+			continue
+		}
+		q := models.Quality{
+			FormatID:   f.ID,
+			Height:     f.Height,
+			Ext:        f.Ext,
+			VCodec:     f.VCodec,
+			ACodec:     f.ACodec,
+			Size:       formatSize(f),
+			AudioOnly:  f.VCodec == "none",
+			Resolution: resolution(f),
+		}
+		if q.AudioOnly {
+			q.Label = "audio " + f.Ext
+			if f.ABR > 0 {
+				q.Label += fmt.Sprintf(" %dk", int(f.ABR))
+			}
+			if old, ok := audios[q.Label]; !ok || q.Size > old.Size {
+				audios[q.Label] = q
+			}
+			continue
+		}
+		q.Label = qualityLabel(f)
+		// 纯视频流下载时会合并最佳音频
+		if f.ACodec == "none" && bestAudio != nil && q.Size > 0 {
+			q.Size += formatSize(*bestAudio)
+		}
+		if old, ok := videos[q.Label]; !ok || betterQuality(q, old) {
+			videos[q.Label] = q
+		}
+	}
+	out := make([]models.Quality, 0, len(videos)+len(audios))
+	for _, q := range videos {
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Height != out[j].Height {
+			return out[i].Height > out[j].Height
+		}
+		return out[i].Label < out[j].Label
+	})
+	audioList := make([]models.Quality, 0, len(audios))
+	for _, q := range audios {
+		audioList = append(audioList, q)
+	}
+	sort.Slice(audioList, func(i, j int) bool { return audioList[i].Size > audioList[j].Size })
+	return append(out, audioList...)
+}
+
+// 优先 mp4 容器，其次自带音频，再比较大小（码率）
+func betterQuality(a, b models.Quality) bool {
+	if (a.Ext == "mp4") != (b.Ext == "mp4") {
+		return a.Ext == "mp4"
+	}
+	if (a.ACodec != "none") != (b.ACodec != "none") {
+		return a.ACodec != "none"
+	}
+	return a.Size > b.Size
+}
+
+func qualityLabel(f models.VideoFormat) string {
+	if f.Height <= 0 {
+		if f.FormatNote != "" {
+			return f.FormatNote
+		}
+		return f.ID
+	}
+	label := strconv.Itoa(f.Height) + "p"
+	if f.FPS > 30 {
+		label += strconv.Itoa(int(f.FPS + 0.5))
+	}
+	return label
+}
+
+func resolution(f models.VideoFormat) string {
+	if f.Width > 0 && f.Height > 0 {
+		return fmt.Sprintf("%dx%d", f.Width, f.Height)
+	}
+	if f.VCodec == "none" {
+		return "audio only"
+	}
+	return ""
+}
+
+func formatSize(f models.VideoFormat) int64 {
+	if f.Size > 0 {
+		return f.Size
+	}
+	return int64(f.SizeApprox)
+}
+
+// ResolveFormat 把用户选择的 format_id 或清晰度标签转换为 yt-dlp -f 参数，maxHeight 为套餐清晰度上限，0 表示不限
+// 最后一个备选项总是单文件格式，推流时使用
+func ResolveFormat(choice string, qualities []models.Quality, maxHeight int) (string, error) {
+	choice = strings.TrimSpace(choice)
+	switch choice {
+	case "", FormatBest:
+		if maxHeight > 0 {
+			// height<=? 不排除没有高度信息的格式
+			return fmt.Sprintf("best[ext=mp4][height<=?%d]/best[height<=?%d]", maxHeight, maxHeight), nil
+		}
+		return DefaultFormatSpec, nil
+	case FormatAudio:
+		return audioFormatSpec, nil
+	}
+	for _, q := range qualities {
+		if q.FormatID != choice && q.Label != choice {
+			continue
+		}
+		if maxHeight > 0 && !q.AudioOnly && q.Height > maxHeight {
+			return "", fmt.Errorf("%w: %s", ErrPlanQuality, choice)
+		}
+		if !q.AudioOnly && q.ACodec == "none" {
+			if q.Height > 0 {
+				return fmt.Sprintf("%s+ba/b[height<=%d]", q.FormatID, q.Height), nil
+			}
+			return q.FormatID + "+ba/b", nil
+		}
+		return q.FormatID, nil
+	}
+	// 列表里没有的清晰度标签按上限选择
+	if match := qualityLabelRe.FindStringSubmatch(choice); match != nil {
+		if h, _ := strconv.Atoi(match[1]); maxHeight > 0 && h > maxHeight {
+			return "", fmt.Errorf("%w: %s", ErrPlanQuality, choice)
+		}
+		return fmt.Sprintf("bv*[height<=%s]+ba/b[height<=%s]", match[1], match[1]), nil
+	}
+	return "", errors.New("unknown format: " + choice)
+}
+
+// StreamFormatSpec 推流输出到 stdout 无法合并音视频，取单文件备选
+func StreamFormatSpec(spec string) string {
+	if spec == "" {
+		return DefaultFormatSpec
+	}
+	if !strings.Contains(spec, "+") {
+		return spec
+	}
+	alts := strings.Split(spec, "/")
+	if last := alts[len(alts)-1]; !strings.Contains(last, "+") {
+		return last
+	}
+	return FormatBest
+}
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"minodl/config"
+	"minodl/log"
+	"minodl/models"
+	"minodl/storage"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLS 切片格式
+const (
+	HLSFMP4 = "fmp4"
+	HLSTS   = "ts"
+
+	HLSPlaylist = "index.m3u8"
+)
+
+const (
+	defaultHLSDir     = "./runtime/hls"
+	hlsSegmentSeconds = "6"
+	hlsWaitTimeout    = 20 * time.Second // 等待切片生成的最长时间
+	hlsIdleTimeout    = 10 * time.Minute // 无人访问的切片目录被清理
+	hlsSweepInterval  = time.Minute
+)
+
+var (
+	ErrHLSFile = errors.New("unknown hls file")
+	ErrHLSKind = errors.New("hls kind must be fmp4 or ts")
+
+	hlsFileRe = regexp.MustCompile(`^(index\.m3u8|init\.mp4|seg_\d{5}\.(m4s|ts))$`)
+	hlsURIRe  = regexp.MustCompile(`URI="([^"]+)"`)
+)
+
+// 本节点的切片会话，同一文件只切一次
+var hlsSessions = struct {
+	sync.Mutex
+	m    map[string]*hlsSession
+	once sync.Once
+}{m: make(map[string]*hlsSession)}
+
+type hlsSession struct {
+	key        string
+	dir        string
+	cancel     context.CancelFunc
+	ready      chan struct{} // start 返回后关闭，之前会话只是占位
+	startErr   error
+	done       chan struct{}
+	err        error
+	mu         sync.Mutex
+	lastAccess time.Time
+}
+
+// HLSDir 切片输出目录
+func HLSDir() string {
+	if dir := config.Get().HLSDir; dir != "" {
+		return dir
+	}
+	return defaultHLSDir
+}
+
+// OpenHLS 返回任务 HLS 文件的本地路径，需要时启动 ffmpeg 切片。
+// 已完成的任务从存储中的文件切片；未完成的任务接入推流边下边切
+func OpenHLS(ctx context.Context, t *models.Task, kind, file string) (string, error) {
+	if kind != HLSFMP4 && kind != HLSTS {
+		return "", ErrHLSKind
+	}
+	if !hlsFileRe.MatchString(file) {
+		return "", ErrHLSFile
+	}
+	s, err := hlsSessionFor(ctx, t, kind)
+	if err != nil {
+		return "", err
+	}
+	s.touch()
+	p := filepath.Join(s.dir, file)
+	// 切片还没写出来时等待，播放器可以在下载完成前开始播放
+	timer := time.NewTimer(hlsWaitTimeout)
+	defer timer.Stop()
+	for {
+		if _, err = os.Stat(p); err == nil {
+			return p, nil
+		}
+		select {
+		case <-s.done:
+			if _, err = os.Stat(p); err == nil {
+				return p, nil
+			}
+			if s.err != nil {
+				return "", s.err
+			}
+			return "", storage.ErrNotFound
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-timer.C:
+			return "", storage.ErrNotFound
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func hlsSessionFor(ctx context.Context, t *models.Task, kind string) (*hlsSession, error) {
+	hlsSessions.once.Do(func() { go sweepHLSSessions() })
+	// 已完成的任务按存储 key 切片，引用同一缓存文件的任务共享
+	source := fmt.Sprintf("task-%d", t.ID)
+	var input string
+	if t.Status == models.StatusCompleted {
+		key := t.FilePath
+		if t.ProcessedPath != "" {
+			key = t.ProcessedPath
+		}
+		if key == "" {
+			return nil, storage.ErrNotFound
+		}
+		sum := sha256.Sum256([]byte(key))
+		source = hex.EncodeToString(sum[:8])
+		input = key
+	}
+	sessionKey := source + "-" + kind
+
+	hlsSessions.Lock()
+	if s, ok := hlsSessions.m[sessionKey]; ok {
+		hlsSessions.Unlock()
+		select {
+		case <-s.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if s.startErr != nil {
+			return nil, s.startErr
+		}
+		return s, nil
+	}
+	// 先放入占位会话再解锁，启动时要访问 Redis、数据库和上游，不能阻塞其他任务的请求
+	s := &hlsSession{
+		key:        sessionKey,
+		dir:        filepath.Join(HLSDir(), sessionKey),
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		lastAccess: time.Now(),
+	}
+	hlsSessions.m[sessionKey] = s
+	hlsSessions.Unlock()
+
+	if err := s.start(t, kind, input); err != nil {
+		s.startErr = err
+		hlsSessions.Lock()
+		if hlsSessions.m[sessionKey] == s {
+			delete(hlsSessions.m, sessionKey)
+		}
+		hlsSessions.Unlock()
+	}
+	close(s.ready)
+	if s.startErr != nil {
+		return nil, s.startErr
+	}
+	return s, nil
+}
+
+// start input 为空时从推流读取。推流与任务的下载互不影响，会话结束或 ffmpeg 退出只会离开推流，
+// 不会取消或完成任务
+func (s *hlsSession) start(t *models.Task, kind, input string) error {
+	_ = os.RemoveAll(s.dir)
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	var stream *StreamReader
+	src := "pipe:0"
+	if input != "" {
+		var err error
+		if src, err = hlsInput(input); err != nil {
+			cancel()
+			return err
+		}
+	} else {
+		var err error
+		if stream, err = joinStream(t, false); err != nil {
+			cancel()
+			return err
+		}
+	}
+	args := []string{"-y", "-hide_banner", "-nostats", "-loglevel", "error", "-i", src,
+		"-map", "0:v:0?", "-map", "0:a:0?", "-c", "copy",
+		"-f", "hls", "-hls_time", hlsSegmentSeconds,
+		// event 类型随切片追加，结束时写入 ENDLIST
+		"-hls_playlist_type", "event",
+		"-hls_flags", "temp_file+independent_segments",
+	}
+	if kind == HLSFMP4 {
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "init.mp4",
+			"-hls_segment_filename", filepath.Join(s.dir, "seg_%05d.m4s"))
+	} else {
+		args = append(args, "-hls_segment_type", "mpegts",
+			"-hls_segment_filename", filepath.Join(s.dir, "seg_%05d.ts"))
+	}
+	args = append(args, filepath.Join(s.dir, HLSPlaylist))
+	cmd := Command(ctx, "ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	var stdin io.WriteCloser
+	if stream != nil {
+		// 自己拷贝而不是设置 cmd.Stdin，ffmpeg 退出后 Wait 不必等待阻塞在推流上的读取
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			cancel()
+			_ = stream.Close()
+			return err
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		if stream != nil {
+			_ = stream.Close()
+		}
+		return err
+	}
+	if stream != nil {
+		go func() {
+			_, _ = io.Copy(stdin, stream)
+			_ = stdin.Close()
+		}()
+	}
+	go func() {
+		err := cmd.Wait()
+		if stream != nil {
+			_ = stream.Close()
+		}
+		if err != nil && ctx.Err() == nil {
+			if msg := lastNonEmptyLine(stderr.String()); msg != "" {
+				err = errors.New(msg)
+			}
+			log.Error("task:%d hls %s err:%v", t.ID, s.key, err)
+			s.err = err
+			// 失败的会话不保留，下次请求重新切片
+			s.remove()
+		}
+		close(s.done)
+	}()
+	return nil
+}
+
+// hlsInput ffmpeg 的输入：本地存储直接读文件，其他后端用可访问的地址
+func hlsInput(key string) (string, error) {
+	if local, ok := storage.Store.(*storage.Local); ok {
+		return local.LocalPath(key)
+	}
+	u := storage.Store.URL(key)
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return "", errors.New("storage backend has no readable url for hls")
+	}
+	return u, nil
+}
+
+func (s *hlsSession) touch() {
+	s.mu.Lock()
+	s.lastAccess = time.Now()
+	s.mu.Unlock()
+}
+
+// starting 会话还在启动，没有可以清理的进程和切片
+func (s *hlsSession) starting() bool {
+	select {
+	case <-s.ready:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *hlsSession) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastAccess) > hlsIdleTimeout
+}
+
+// remove 结束会话并删除切片
+func (s *hlsSession) remove() {
+	hlsSessions.Lock()
+	if hlsSessions.m[s.key] == s {
+		delete(hlsSessions.m, s.key)
+	}
+	hlsSessions.Unlock()
+	s.cancel()
+	_ = os.RemoveAll(s.dir)
+}
+
+// sweepHLSSessions 定期清理长时间无人访问的会话，切片可以随时重新生成
+func sweepHLSSessions() {
+	ticker := time.NewTicker(hlsSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		hlsSessions.Lock()
+		var idle []*hlsSession
+		for _, s := range hlsSessions.m {
+			if s.starting() {
+				continue
+			}
+			if s.idle() {
+				idle = append(idle, s)
+			}
+		}
+		hlsSessions.Unlock()
+		for _, s := range idle {
+			s.remove()
+		}
+	}
+}
+
+// SignPlaylist 签名链接的播放列表里，切片地址带上同样的签名参数
+func SignPlaylist(playlist []byte, query string) []byte {
+	lines := strings.Split(string(playlist), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			lines[i] = hlsURIRe.ReplaceAllString(line, `URI="${1}?`+query+`"`)
+		default:
+			lines[i] = line + "?" + query
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
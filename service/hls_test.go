@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"minodl/models"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg 用脚本代替 PATH 中的 ffmpeg
+func fakeFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as ffmpeg")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// 未完成任务的 HLS 会话接入推流，会话因 ffmpeg 退出或空闲清理结束时，任务和队列中的下载都不受影响
+func TestHLSSessionEndLeavesTask(t *testing.T) {
+	cases := []struct {
+		name   string
+		ffmpeg string
+		end    func(s *hlsSession)
+	}{
+		{name: "ffmpeg exits", ffmpeg: "exit 1"},
+		{name: "idle sweep", ffmpeg: "exec cat >/dev/null", end: func(s *hlsSession) { s.remove() }},
+	}
+	grace := streamIdleGrace
+	streamIdleGrace = 10 * time.Millisecond
+	defer func() { streamIdleGrace = grace }()
+
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			withoutRedis(t)
+			fakeFFmpeg(t, c.ffmpeg)
+			fake := &FakeExtractor{Content: []byte("head"), Hold: make(chan struct{})}
+			withExtractors(t, map[string][]string{"stream.test": {"fake"}}, fake)
+			task := &models.Task{ID: uint(9100 + i), SourceURL: "https://stream.test/v/hls", Status: models.StatusRunning, Progress: 40}
+			queueCtx, done := TrackProcess(context.Background(), task.ID)
+			defer done()
+			events, unsubscribe := Events.SubscribeTask(task.ID)
+			defer unsubscribe()
+
+			b, r := startTestBroadcast(t, task, 1024)
+			s := &hlsSession{key: c.name, dir: t.TempDir(), done: make(chan struct{}), lastAccess: time.Now()}
+			if err := s.start(task, HLSTS, ""); err != nil {
+				t.Fatal(err)
+			}
+			_ = r.Close()
+			if c.end != nil {
+				c.end(s)
+			}
+			select {
+			case <-s.done:
+			case <-time.After(3 * time.Second):
+				t.Fatal("hls session did not end")
+			}
+			// 最后一个观众离开后推流停止
+			deadline := time.Now().Add(3 * time.Second)
+			for {
+				b.mu.Lock()
+				finished := b.done
+				b.mu.Unlock()
+				if finished {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("stream kept running after the hls session ended")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if queueCtx.Err() != nil {
+				t.Fatal("hls session cancelled the queue download")
+			}
+			if task.Status != models.StatusRunning || task.Progress != 40 {
+				t.Fatalf("hls session changed the task: status %s progress %v", task.Status, task.Progress)
+			}
+			expectNoEvents(t, events)
+		})
+	}
+}
+
+// 会话启动期间不持有全局锁，同一会话的请求等待启动结果
+func TestHLSSessionStartOutsideLock(t *testing.T) {
+	cases := []struct {
+		name     string
+		startErr error
+	}{
+		{name: "started"},
+		{name: "start failed", startErr: errors.New("quota exceeded")},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			task := &models.Task{ID: uint(9200 + i), Status: models.StatusRunning}
+			key := fmt.Sprintf("task-%d-%s", task.ID, HLSTS)
+			s := &hlsSession{key: key, ready: make(chan struct{}), done: make(chan struct{}), lastAccess: time.Now()}
+			hlsSessions.Lock()
+			hlsSessions.m[key] = s
+			hlsSessions.Unlock()
+			defer func() {
+				hlsSessions.Lock()
+				delete(hlsSessions.m, key)
+				hlsSessions.Unlock()
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			if _, err := hlsSessionFor(ctx, task, HLSTS); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("request during start: %v, want it to wait until its context ends", err)
+			}
+
+			type result struct {
+				s   *hlsSession
+				err error
+			}
+			got := make(chan result, 1)
+			go func() {
+				s, err := hlsSessionFor(context.Background(), task, HLSTS)
+				got <- result{s, err}
+			}()
+			time.Sleep(20 * time.Millisecond)
+			if !hlsSessions.TryLock() {
+				t.Fatal("hls sessions lock held while a session is starting")
+			}
+			hlsSessions.Unlock()
+			if !s.starting() {
+				t.Fatal("placeholder session reported as started")
+			}
+
+			s.startErr = c.startErr
+			close(s.ready)
+			select {
+			case r := <-got:
+				if r.err != c.startErr {
+					t.Fatalf("err = %v, want %v", r.err, c.startErr)
+				}
+				if c.startErr == nil && r.s != s {
+					t.Fatal("waiting request got a different session")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("waiting request not released after start")
+			}
+		})
+	}
+}
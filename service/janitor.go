@@ -0,0 +1,41 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Janitor 定期执行的后台清理
+type Janitor struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startJanitor 启动后立即执行一次，之后每隔 interval 执行
+func startJanitor(interval time.Duration, run func(ctx context.Context)) *Janitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Janitor{cancel: cancel}
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			run(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return j
+}
+
+func (j *Janitor) Stop() {
+	if j.cancel != nil {
+		j.cancel()
+	}
+	j.wg.Wait()
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/models"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	parseCachePrefix = "parse:"
+	parseCacheTTL    = time.Hour
+	parseCacheWait   = 2 * time.Second // 读写 Redis 的超时，缓存不可用时直接解析
+)
+
+// 各站点解析结果的有效期，抖音、小红书的页面数据变化快
+var parseCacheTTLs = []struct {
+	host string
+	ttl  time.Duration
+}{
+	{YouTube, 6 * time.Hour},
+	{"youtu.be", 6 * time.Hour},
+	{BILIBILI, 6 * time.Hour},
+	{"b23.tv", 6 * time.Hour},
+	{DouYin, 30 * time.Minute},
+	{XHS, 30 * time.Minute},
+	{"xhslink.com", 30 * time.Minute},
+}
+
+// 带有效期签名的链接参数，这类地址过期后无法访问，不能进入缓存
+var expiringParams = []string{"x-expires", "expires", "expire", "deadline", "x-oss-expires", "x-amz-expires", "e"}
+
+var parseFlight singleflight.Group
+
+// ParseVideoInfo 解析视频信息，videoUrl 可以是分享文案。结果按规范化的链接缓存在 Redis，
+// 同一链接的并发请求只启动一次 yt-dlp。用户在该站点保存了登录信息时带上登录信息解析
+func ParseVideoInfo(userID uint, videoUrl string) (*models.VideoResult, error) {
+	videoUrl, err := ResolveShareURL(context.Background(), videoUrl)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := siteAuthFor(userID, videoUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer auth.Close()
+	key := parseCacheKey(videoUrl)
+	if auth != nil {
+		// 登录后才能看到的内容只缓存给该用户
+		key += ":u" + strconv.FormatUint(uint64(userID), 10)
+	}
+	if info, ok := getParseCache(key); ok {
+		return info, nil
+	}
+	v, err, _ := parseFlight.Do(key, func() (interface{}, error) {
+		// 等待期间其他请求可能已经写入缓存
+		if info, ok := getParseCache(key); ok {
+			return info, nil
+		}
+		info, err := extractVideoInfo(videoUrl, auth)
+		if err != nil {
+			return nil, err
+		}
+		setParseCache(key, info, parseTTL(videoUrl))
+		return info, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*models.VideoResult), nil
+}
+
+func parseCacheKey(videoUrl string) string {
+	sum := sha256.Sum256([]byte(normalizeSourceURL(videoUrl)))
+	return parseCachePrefix + hex.EncodeToString(sum[:])
+}
+
+func parseTTL(videoUrl string) time.Duration {
+	for _, s := range parseCacheTTLs {
+		if strings.Contains(videoUrl, s.host) {
+			return s.ttl
+		}
+	}
+	return parseCacheTTL
+}
+
+func getParseCache(key string) (*models.VideoResult, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), parseCacheWait)
+	defer cancel()
+	val, err := dao.CacheGet(ctx, key)
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get parse cache %s err:%v", key, err)
+		}
+		return nil, false
+	}
+	var info models.VideoResult
+	if err = json.Unmarshal([]byte(val), &info); err != nil {
+		log.Error("decode parse cache %s err:%v", key, err)
+		return nil, false
+	}
+	return &info, true
+}
+
+func setParseCache(key string, info *models.VideoResult, ttl time.Duration) {
+	data, err := json.Marshal(cacheableResult(info))
+	if err != nil {
+		log.Error("encode parse cache %s err:%v", key, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), parseCacheWait)
+	defer cancel()
+	if err = dao.CacheSet(ctx, key, string(data), ttl); err != nil {
+		log.Error("set parse cache %s err:%v", key, err)
+	}
+}
+
+// cacheableResult 去掉会过期的直链。解析结果只含页面地址和格式信息，
+// 唯一可能是签名直链的是封面，带过期参数的封面解析时已镜像，这里兜底
+func cacheableResult(info *models.VideoResult) *models.VideoResult {
+	out := *info
+	if isExpiringURL(out.Thumbnail) {
+		out.Thumbnail = ""
+	}
+	return &out
+}
+
+func isExpiringURL(raw string) bool {
+	if raw == "" {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return true
+	}
+	for k := range u.Query() {
+		for _, p := range expiringParams {
+			if strings.EqualFold(k, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// InvalidateParseCache 删除某个链接的解析缓存，包括各用户带登录信息的结果，返回删除的条数。
+// 链接和解析时一样先转换成规范地址，分享文案和短链也能命中
+func InvalidateParseCache(ctx context.Context, videoUrl string) (int64, error) {
+	videoUrl, err := ResolveShareURL(ctx, videoUrl)
+	if err != nil {
+		return 0, err
+	}
+	return dao.CacheDeletePrefix(ctx, parseCacheKey(videoUrl))
+}
+
+// ClearParseCache 删除全部解析缓存
+func ClearParseCache(ctx context.Context) (int64, error) {
+	return dao.CacheDeletePrefix(ctx, parseCachePrefix)
+}
@@ -1,15 +1,14 @@
 package service
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
+	"context"
 	"minodl/log"
 	"minodl/models"
-	"os/exec"
-	"strings"
 )
 
+// 播放列表/频道最多展开的条目数
+const maxPlaylistEntries = 500
+
 const (
 	BILIBILI = "bilibili.com"
 	YouTube  = "youtube.com"
@@ -17,53 +16,69 @@ const (
 	XHS      = "xiaohongshu.com"
 )
 
-func ParseVideoInfo(videoUrl string) (*models.VideoResult, error) {
-	cmd := exec.Command("yt-dlp", "--dump-single-json", videoUrl)
-	/*if strings.Contains(videoUrl, "youtube.com") {
-		cmd = exec.Command("yt-dlp", "--add-header", forwarded, "--cookies", youtubeCookies, "--dump-single-json", videoUrl)
-	}*/
-	// 捕获标准输出和标准错误
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	// 运行命令
-	err := cmd.Run()
-	if err != nil {
-		log.Error(fmt.Sprint(err) + ": " + stderr.String())
-		return nil, err
-	}
-	var videoInfo models.VideoInfo
-	// 解析JSON输出
-	err = json.Unmarshal(out.Bytes(), &videoInfo)
+// extractVideoInfo 按域名选择后端解析，外部通过 ParseVideoInfo 使用缓存
+func extractVideoInfo(videoUrl string, auth *SiteAuth) (*models.VideoResult, error) {
+	videoInfo, err := probeVideo(context.Background(), videoUrl, auth)
 	if err != nil {
-		log.Error("解析JSON失败:%v", err)
-		return nil, err
+		return nil, authFailure(auth, err)
 	}
-	// 需要单独保持封面
-	if strings.Contains(videoUrl, YouTube) ||
-		strings.Contains(videoUrl, BILIBILI) {
-		/*working, _ := os.Getwd()
-		ImageId := uuid.New().String()
-		day := time.Now().Format("2006-01-02")
-		tempDir := fmt.Sprintf("%s/web/%s/", working, day)
-		os.MkdirAll(tempDir, os.ModePerm)
-		tempImage := fmt.Sprintf("%s%s.webp", tempDir, ImageId)
-		dlCmd := fmt.Sprintf("wget -O %s %s", tempImage, videoInfo.Thumbnail)
-		_, err = util.Cmd(dlCmd, true)
-		if err != nil {
-			log.Error("download video cover %s error: %s", videoInfo.Thumbnail, err)
-		} else {
-			h.Image = fmt.Sprintf("https://%s/statics/%s/%s.webp", ictx.Request().Host, day, ImageId)
-			videoInfo.Thumbnail = h.Image
-			ret.Thumbnail = h.Image
-			log.Release("download image to %s, url %s", tempImage, h.Image)
-		}*/
+	credentialUsed(auth)
+	// 需要单独保持封面，带过期签名的封面也镜像，解析结果缓存后仍可访问
+	if videoInfo.Thumbnail != "" && (needsCoverMirror(videoUrl) || isExpiringURL(videoInfo.Thumbnail)) {
+		videoInfo.Thumbnail = MirrorThumbnail(videoInfo.Thumbnail)
 	}
 	// 输出视频标题
 	log.Info("视频标题:%s", videoInfo.Title)
 	log.Info("视频URL:%s", videoInfo.URL)
-	log.Info("视频时长:%d", videoInfo.Duration)
+	log.Info("视频时长:%.0f", videoInfo.Duration)
 	log.Info("封面URL:%s", videoInfo.Thumbnail)
-	return &models.VideoResult{Title: videoInfo.Title, Thumbnail: videoInfo.Thumbnail, Qualities: make([]map[string]string, 0)}, nil
+	if videoInfo.Type == "playlist" {
+		return &models.VideoResult{
+			IsPlaylist: true,
+			URL:        videoUrl,
+			Extractor:  videoInfo.Extractor,
+			VideoID:    videoInfo.ID,
+			Entries:    playlistEntries(videoInfo.Entries),
+			Title:      videoInfo.Title,
+			Thumbnail:  videoInfo.Thumbnail,
+			Qualities:  make([]models.Quality, 0),
+			Subtitles:  make([]models.Subtitle, 0),
+		}, nil
+	}
+	return &models.VideoResult{
+		URL:       videoUrl,
+		Extractor: videoInfo.Extractor,
+		VideoID:   videoInfo.ID,
+		Title:     videoInfo.Title,
+		Duration:  int(videoInfo.Duration),
+		Thumbnail: videoInfo.Thumbnail,
+		Qualities: buildQualities(videoInfo.Formats),
+		Subtitles: buildSubtitles(videoInfo.Subtitles, videoInfo.AutoCaptions),
+		Images:    mirrorImages(videoInfo.Images),
+	}, nil
+}
+
+// mirrorImages 图集图片的 CDN 地址带时效签名，和封面一样镜像
+func mirrorImages(images []string) []string {
+	if len(images) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(images))
+	for _, src := range images {
+		out = append(out, MirrorThumbnail(src))
+	}
+	return out
+}
+
+// playlistEntries 编号并过滤没有地址的条目（已删除、私有视频）
+func playlistEntries(entries []models.PlaylistEntry) []models.PlaylistEntry {
+	out := make([]models.PlaylistEntry, 0, len(entries))
+	for i, e := range entries {
+		if e.URL == "" {
+			continue
+		}
+		e.Index = i + 1
+		out = append(out, e)
+	}
+	return out
 }
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/models"
+)
+
+// createPlaylistTask 播放列表、频道、分P视频：父任务只汇总进度，选中的条目各自作为子任务入队
+func createPlaylistTask(u *models.User, sourceURL string, info *models.VideoResult, spec string, opts TaskOptions) (*models.Task, error) {
+	entries, err := selectEntries(info.Entries, opts.Entries)
+	if err != nil {
+		return nil, err
+	}
+	priority := planPriority(u.Plan)
+	parent := &models.Task{
+		UserID:         u.ID,
+		Title:          info.Title,
+		SourceURL:      sourceURL,
+		Status:         models.StatusPending,
+		Priority:       priority,
+		Format:         opts.Format,
+		Profile:        opts.Profile,
+		ChildCount:     len(entries),
+		NotBefore:      opts.NotBefore,
+		SubscriptionID: opts.SubscriptionID,
+	}
+	children := make([]*models.Task, 0, len(entries))
+	var cached []*models.MediaCache
+	for _, e := range entries {
+		title := e.Title
+		if title == "" {
+			title = fmt.Sprintf("%s P%d", info.Title, e.Index)
+		}
+		child := &models.Task{
+			UserID:     u.ID,
+			Title:      title,
+			SourceURL:  e.URL,
+			Status:     models.StatusPending,
+			Priority:   priority,
+			Format:     opts.Format,
+			FormatSpec: spec,
+			Duration:   int(e.Duration),
+			Profile:    opts.Profile,
+			NotBefore:  opts.NotBefore,
+		}
+		// 条目的字幕在下载时才知道，缺少的语言会被 yt-dlp 跳过
+		if err = applySubtitleOptions(child, opts.Subtitles, nil); err != nil {
+			return nil, err
+		}
+		child.CacheKey = mediaCacheKey(e.IEKey, e.ID, e.URL, spec, cacheVariant(child))
+		if entry := lookupMediaCache(context.Background(), child.CacheKey); entry != nil {
+			applyMediaCache(child, entry)
+			cached = append(cached, entry)
+		}
+		children = append(children, child)
+	}
+	// 每个条目算一个任务
+	refund, err := consumeTaskQuota(u, len(children))
+	if err != nil {
+		for _, entry := range cached {
+			_ = dao.ReleaseMediaCache(entry.ID)
+		}
+		return nil, err
+	}
+	if err = dao.CreateTaskWithChildren(parent, children); err != nil {
+		refund()
+		for _, entry := range cached {
+			_ = dao.ReleaseMediaCache(entry.ID)
+		}
+		return nil, err
+	}
+	if Queue != nil {
+		for _, child := range children {
+			if child.Status == models.StatusPending {
+				Queue.Schedule(child)
+			}
+		}
+	}
+	if len(cached) > 0 {
+		// 条目全部命中缓存时父任务直接完成
+		refreshParent(parent.ID)
+		if p, err := dao.GetTaskByID(parent.ID); err == nil {
+			parent = p
+		}
+	}
+	return parent, nil
+}
+
+// selectEntries 按用户选择的序号过滤条目，未选择时全部下载
+func selectEntries(all []models.PlaylistEntry, picked []int) ([]models.PlaylistEntry, error) {
+	if len(all) == 0 {
+		return nil, errors.New("playlist has no downloadable entries")
+	}
+	if len(picked) == 0 {
+		return all, nil
+	}
+	byIndex := make(map[int]models.PlaylistEntry, len(all))
+	for _, e := range all {
+		byIndex[e.Index] = e
+	}
+	out := make([]models.PlaylistEntry, 0, len(picked))
+	seen := make(map[int]bool, len(picked))
+	for _, idx := range picked {
+		e, ok := byIndex[idx]
+		if !ok {
+			return nil, fmt.Errorf("playlist entry %d not found", idx)
+		}
+		if !seen[idx] {
+			seen[idx] = true
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// refreshParent 根据子任务汇总父任务的进度和状态，只写汇总的列。父任务已结束或被取消时不再改动
+func refreshParent(parentID uint) {
+	typ := EventProgress
+	parent, err := dao.UpdateParentTask(parentID, func(parent *models.Task, children []models.Task) []string {
+		if len(children) == 0 {
+			return nil
+		}
+		var total, speed float64
+		var downloaded, size int64
+		var active, running, completed, failed int
+		for _, child := range children {
+			downloaded += child.DownloadedBytes
+			size += child.TotalBytes
+			switch child.Status {
+			case models.StatusPending:
+				active++
+				total += child.Progress
+			case models.StatusRunning:
+				active++
+				running++
+				total += child.Progress
+				speed += child.Speed
+			case models.StatusCompleted:
+				completed++
+				total += 100
+			case models.StatusFailed:
+				failed++
+				total += 100
+			default:
+				total += 100
+			}
+		}
+		status := models.StatusPending
+		switch {
+		case running > 0:
+			status = models.StatusRunning
+		case active > 0:
+			if completed+failed > 0 {
+				status = models.StatusRunning
+			}
+		case completed > 0:
+			status = models.StatusCompleted
+		case failed > 0:
+			status = models.StatusFailed
+		default:
+			status = models.StatusCancelled
+		}
+		progress := roundPercent(total / float64(len(children)))
+		// 失败的条目重试成功后清掉错误
+		errorMsg := ""
+		if failed > 0 {
+			errorMsg = fmt.Sprintf("%d of %d entries failed", failed, len(children))
+		}
+		if parent.Status == status && parent.Progress == progress && parent.DownloadedBytes == downloaded &&
+			parent.ErrorMsg == errorMsg {
+			return nil
+		}
+		if parent.Status != status {
+			typ = EventStatus
+		}
+		parent.Status = status
+		parent.Progress = progress
+		parent.DownloadedBytes = downloaded
+		parent.TotalBytes = size
+		parent.Speed = speed
+		parent.ErrorMsg = errorMsg
+		return []string{"status", "progress", "downloaded_bytes", "total_bytes", "speed", "error_msg"}
+	})
+	if err != nil {
+		log.Error("refresh parent task:%d err:%v", parentID, err)
+		return
+	}
+	if parent != nil {
+		Events.Publish(NewTaskTracker(parent).event(typ))
+	}
+}
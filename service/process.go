@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrTaskCancelled 用户主动取消或推流客户端断开
+var ErrTaskCancelled = errors.New("task cancelled")
+
+// 本节点正在执行的 yt-dlp 进程，task_id -> *trackedProcess
+var processes sync.Map
+
+type trackedProcess struct {
+	cancel context.CancelCauseFunc
+}
+
+// Command 创建独立进程组的命令，ctx 结束时杀掉整个进程组（yt-dlp 及其拉起的 ffmpeg）
+func Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+// TrackProcess 登记任务进程，返回任务上下文和注销函数
+func TrackProcess(parent context.Context, taskID uint) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	p := &trackedProcess{cancel: cancel}
+	processes.Store(taskID, p)
+	return ctx, func() {
+		processes.CompareAndDelete(taskID, p)
+		cancel(nil)
+	}
+}
+
+// cancelProcess 取消本节点上的任务进程，不在本节点时忽略
+func cancelProcess(taskID uint) bool {
+	if v, ok := processes.Load(taskID); ok {
+		v.(*trackedProcess).cancel(ErrTaskCancelled)
+		return true
+	}
+	return false
+}
+
+// IsCancelled 上下文是否因任务取消而结束
+func IsCancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrTaskCancelled)
+}
+
+// cleanPartialFiles 删除任务残留的下载文件
+func cleanPartialFiles(taskID uint) {
+	matches, _ := filepath.Glob(filepath.Join(DownloadDir(), fmt.Sprintf("%d.*", taskID)))
+	for _, f := range matches {
+		_ = os.Remove(f)
+	}
+}
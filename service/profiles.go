@@ -0,0 +1,122 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Profile 下载完成后的 ffmpeg 后处理配置
+type Profile struct {
+	Name      string   `json:"name"`
+	Title     string   `json:"title"`
+	Ext       string   `json:"ext"`
+	AudioOnly bool     `json:"audio_only"`
+	Args      []string `json:"-"` // ffmpeg 输出参数
+}
+
+var profiles = map[string]Profile{
+	"mp3-320": {
+		Name: "mp3-320", Title: "MP3 320kbps", Ext: "mp3", AudioOnly: true,
+		Args: []string{"-vn", "-c:a", "libmp3lame", "-b:a", "320k"},
+	},
+	"m4a": {
+		Name: "m4a", Title: "AAC audio (m4a)", Ext: "m4a", AudioOnly: true,
+		Args: []string{"-vn", "-c:a", "aac", "-b:a", "192k", "-movflags", "+faststart"},
+	},
+	"720p-h264": {
+		Name: "720p-h264", Title: "720p H.264", Ext: "mp4",
+		Args: []string{
+			"-vf", "scale=-2:'min(720,ih)'",
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+			"-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart",
+		},
+	},
+	"whatsapp": {
+		Name: "whatsapp", Title: "Compressed for WhatsApp", Ext: "mp4",
+		Args: []string{
+			"-vf", "scale=-2:'min(480,ih)'", "-r", "30",
+			"-c:v", "libx264", "-profile:v", "baseline", "-level", "3.0", "-preset", "veryfast", "-crf", "28", "-pix_fmt", "yuv420p",
+			"-c:a", "aac", "-b:a", "96k", "-ac", "2", "-movflags", "+faststart",
+		},
+	},
+}
+
+// Profiles 所有后处理配置，按名称排序
+func Profiles() []Profile {
+	out := make([]Profile, 0, len(profiles))
+	for _, p := range profiles {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func GetProfile(name string) (Profile, bool) {
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// runPostprocess 对已下载文件执行 ffmpeg，返回输出文件路径
+func runPostprocess(ctx context.Context, tracker *TaskTracker, profile Profile, input string) (string, error) {
+	output := fmt.Sprintf("%s.%s.%s", strings.TrimSuffix(input, extOf(input)), profile.Name, profile.Ext)
+	args := append([]string{"-y", "-hide_banner", "-nostats", "-i", input}, profile.Args...)
+	if err := runFFmpeg(ctx, tracker, append(args, output)); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// runFFmpeg 执行 ffmpeg 并上报后处理进度，args 的最后一项是输出文件
+func runFFmpeg(ctx context.Context, tracker *TaskTracker, args []string) error {
+	t := tracker.t
+	output := args[len(args)-1]
+	args = append(append(args[:len(args)-1:len(args)-1], "-progress", "pipe:1"), output)
+	cmd := Command(ctx, "ffmpeg", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	tracker.StageProgress(StagePostprocess, 0)
+	// -progress 输出 key=value，out_time_us 为已处理时长
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || (key != "out_time_us" && key != "out_time_ms") || t.Duration <= 0 {
+			continue
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || us < 0 {
+			continue
+		}
+		pct := float64(us) / 1e6 / float64(t.Duration) * 100
+		if pct > 100 {
+			pct = 100
+		}
+		tracker.StageProgress(StagePostprocess, pct)
+	}
+	if err = cmd.Wait(); err != nil {
+		if msg := lastNonEmptyLine(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		return err
+	}
+	tracker.StageProgress(StagePostprocess, 100)
+	return nil
+}
+
+func extOf(p string) string {
+	if i := strings.LastIndex(p, "."); i > strings.LastIndex(p, "/") {
+		return p[i:]
+	}
+	return ""
+}
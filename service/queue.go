@@ -0,0 +1,250 @@
+package service
+
+import (
+	"container/heap"
+	"context"
+	"minodl/config"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/models"
+	"minodl/utils"
+	"sync"
+	"time"
+)
+
+const defaultDownloadWorkers = 2
+
+// Queue 全局后台下载队列，dl 服务启动时初始化
+var Queue *DownloadQueue
+
+type downloadJob struct {
+	taskID   uint
+	priority int
+	seq      uint64 // 同优先级先进先出
+}
+
+type jobHeap []*downloadJob
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(*downloadJob)) }
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return job
+}
+
+// DownloadQueue 按套餐优先级调度的下载队列，由固定数量的 worker 并发消费
+type DownloadQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    jobHeap
+	queued  map[uint]struct{}
+	seq     uint64
+	workers int
+	closed  bool
+	delayed map[uint]*time.Timer // 等待到时间入队的任务
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// InitDownloadQueue 启动 worker，并把库里仍处于 pending 的任务重新入队
+func InitDownloadQueue(cfg *config.Config) *DownloadQueue {
+	workers := cfg.DownloadWorkers
+	if workers <= 0 {
+		workers = defaultDownloadWorkers
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &DownloadQueue{
+		queued:  make(map[uint]struct{}),
+		delayed: make(map[uint]*time.Timer),
+		workers: workers,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	Queue = q
+	if pending, err := dao.ListTasksByStatus(models.StatusPending); err == nil {
+		for i := range pending {
+			t := &pending[i]
+			// 播放列表父任务不下载
+			if t.ChildCount > 0 {
+				continue
+			}
+			q.Schedule(t)
+		}
+		log.Info("download queue started, workers:%d, recovered:%d", workers, len(pending))
+	} else {
+		log.Error("recover pending tasks err:%v", err)
+	}
+	return q
+}
+
+// Push 任务入队，已在队列中或队列已关闭时返回 false。任务有延迟入队的预约时一并取消
+func (q *DownloadQueue) Push(t *models.Task) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stopDelayed(t.ID)
+	return q.push(t.ID, t.Priority)
+}
+
+func (q *DownloadQueue) push(taskID uint, priority int) bool {
+	if q.closed {
+		return false
+	}
+	if _, ok := q.queued[taskID]; ok {
+		return false
+	}
+	q.seq++
+	heap.Push(&q.jobs, &downloadJob{taskID: taskID, priority: priority, seq: q.seq})
+	q.queued[taskID] = struct{}{}
+	q.cond.Signal()
+	return true
+}
+
+// PushAt 延迟入队，用于失败重试和预约下载。同一任务只保留最后一次预约，
+// 定时器只记任务 ID 和优先级，任务取消、删除或队列停止时取消
+func (q *DownloadQueue) PushAt(t *models.Task, at time.Time) {
+	taskID, priority := t.ID, t.Priority
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.stopDelayed(taskID)
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(at), func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.delayed[taskID] != timer {
+			return
+		}
+		delete(q.delayed, taskID)
+		q.push(taskID, priority)
+	})
+	q.delayed[taskID] = timer
+}
+
+// Remove 取消任务的延迟入队，任务被取消或删除时调用
+func (q *DownloadQueue) Remove(taskID uint) {
+	q.mu.Lock()
+	q.stopDelayed(taskID)
+	q.mu.Unlock()
+}
+
+// stopDelayed 调用方持有 q.mu
+func (q *DownloadQueue) stopDelayed(taskID uint) {
+	if timer, ok := q.delayed[taskID]; ok {
+		timer.Stop()
+		delete(q.delayed, taskID)
+	}
+}
+
+// Schedule 等待重试或未到 NotBefore 的任务按较晚的时间入队，否则立即入队
+func (q *DownloadQueue) Schedule(t *models.Task) {
+	var at time.Time
+	if t.NextRetryAt != nil {
+		at = *t.NextRetryAt
+	}
+	if t.NotBefore != nil && t.NotBefore.After(at) {
+		at = *t.NotBefore
+	}
+	if at.After(time.Now()) {
+		q.PushAt(t, at)
+		return
+	}
+	q.Push(t)
+}
+
+// Len 等待中的任务数
+func (q *DownloadQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.jobs.Len()
+}
+
+func (q *DownloadQueue) pop() (*downloadJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.jobs.Len() == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	job := heap.Pop(&q.jobs).(*downloadJob)
+	delete(q.queued, job.taskID)
+	return job, true
+}
+
+func (q *DownloadQueue) work() {
+	defer q.wg.Done()
+	for {
+		job, ok := q.pop()
+		if !ok {
+			return
+		}
+		utils.SafeCall(func() { q.run(job.taskID) })
+	}
+}
+
+func (q *DownloadQueue) run(taskID uint) {
+	// 多节点共享任务表，认领成功的节点才执行
+	claimed, err := dao.ClaimTask(taskID)
+	if err != nil {
+		log.Error("claim task:%d err:%v", taskID, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	t, err := dao.GetTaskByID(taskID)
+	if err != nil {
+		log.Error("load task:%d err:%v", taskID, err)
+		return
+	}
+	t.Attempts++
+	t.NextRetryAt = nil
+	if err = runDownload(q.ctx, t); err != nil {
+		log.Error("download task:%d err:%v", taskID, err)
+	}
+}
+
+// Stop 停止接收新任务，中断正在执行的下载并等待 worker 退出
+func (q *DownloadQueue) Stop() {
+	q.mu.Lock()
+	q.closed = true
+	for taskID := range q.delayed {
+		q.stopDelayed(taskID)
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.cancel()
+	q.wg.Wait()
+}
+
+// planPriority 套餐越高优先级越高
+func planPriority(plan string) int {
+	switch plan {
+	case models.PlanUltra:
+		return 2
+	case models.PlanPro:
+		return 1
+	default:
+		return 0
+	}
+}
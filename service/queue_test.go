@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"minodl/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestQueue 没有 worker 的队列，只检查入队
+func newTestQueue() *DownloadQueue {
+	q := &DownloadQueue{queued: make(map[uint]struct{}), delayed: make(map[uint]*time.Timer)}
+	q.cond = sync.NewCond(&q.mu)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	return q
+}
+
+func TestQueueSchedule(t *testing.T) {
+	cases := []struct {
+		name        string
+		nextRetryAt time.Duration // 相对入队时间，0 表示不设置
+		notBefore   time.Duration
+		wantAfter   time.Duration // 0 表示立即入队
+	}{
+		{name: "no delay"},
+		{name: "times already passed", nextRetryAt: -time.Minute, notBefore: -time.Minute},
+		{name: "retry", nextRetryAt: 50 * time.Millisecond, wantAfter: 50 * time.Millisecond},
+		{name: "not before", notBefore: 50 * time.Millisecond, wantAfter: 50 * time.Millisecond},
+		// 取较晚的时间
+		{name: "not before after retry", nextRetryAt: 50 * time.Millisecond, notBefore: 150 * time.Millisecond, wantAfter: 150 * time.Millisecond},
+		{name: "retry after not before", nextRetryAt: 150 * time.Millisecond, notBefore: 50 * time.Millisecond, wantAfter: 150 * time.Millisecond},
+		{name: "retry pending, not before passed", nextRetryAt: 50 * time.Millisecond, notBefore: -time.Minute, wantAfter: 50 * time.Millisecond},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now := time.Now()
+			task := &models.Task{ID: uint(i + 1)}
+			if c.nextRetryAt != 0 {
+				at := now.Add(c.nextRetryAt)
+				task.NextRetryAt = &at
+			}
+			if c.notBefore != 0 {
+				at := now.Add(c.notBefore)
+				task.NotBefore = &at
+			}
+			q := newTestQueue()
+			q.Schedule(task)
+			if c.wantAfter == 0 {
+				if q.Len() != 1 {
+					t.Fatal("task was not queued immediately")
+				}
+				return
+			}
+			if q.Len() != 0 {
+				t.Fatal("delayed task was queued immediately")
+			}
+			deadline := now.Add(c.wantAfter)
+			for q.Len() == 0 {
+				if time.Since(deadline) > 2*time.Second {
+					t.Fatal("delayed task was never queued")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if early := time.Until(deadline); early > 0 {
+				t.Errorf("task queued %v early", early)
+			}
+		})
+	}
+}
+
+// 延迟入队的定时器在任务取消、重新预约和队列停止时取消，到时间后不再留在队列里
+func TestQueueDelayedTimers(t *testing.T) {
+	cases := []struct {
+		name        string
+		after       func(q *DownloadQueue, task *models.Task)
+		wantQueue   bool
+		wantDelayed int
+	}{
+		{name: "fires", wantQueue: true},
+		{name: "removed", after: func(q *DownloadQueue, task *models.Task) { q.Remove(task.ID) }},
+		{name: "queue stopped", after: func(q *DownloadQueue, task *models.Task) { q.Stop() }},
+		{name: "pushed now", after: func(q *DownloadQueue, task *models.Task) {
+			q.Push(task)
+			q.pop()
+		}},
+		{name: "rescheduled later", after: func(q *DownloadQueue, task *models.Task) {
+			q.PushAt(task, time.Now().Add(time.Hour))
+		}, wantDelayed: 1},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := newTestQueue()
+			defer q.Stop()
+			task := &models.Task{ID: uint(100 + i)}
+			q.PushAt(task, time.Now().Add(30*time.Millisecond))
+			if c.after != nil {
+				c.after(q, task)
+			}
+			time.Sleep(80 * time.Millisecond)
+			if got := q.Len() == 1; got != c.wantQueue {
+				t.Fatalf("queued = %v, want %v", got, c.wantQueue)
+			}
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			if len(q.delayed) != c.wantDelayed {
+				t.Errorf("%d delayed timers kept, want %d", len(q.delayed), c.wantDelayed)
+			}
+		})
+	}
+}
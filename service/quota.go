@@ -0,0 +1,260 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/models"
+	"strconv"
+	"time"
+)
+
+// 额度类型，也是 429 响应中的 quota 字段
+const (
+	QuotaTasksPerDay  = "tasks_per_day"
+	QuotaConcurrent   = "concurrent"
+	QuotaMonthlyBytes = "monthly_bytes"
+
+	quotaTimeout    = 2 * time.Second
+	slotLease       = 2 * time.Minute // 下载中每分钟续约，节点崩溃时名额最多占用这么久
+	slotRefresh     = time.Minute
+	quotaRetryDelay = 30 * time.Second // 并发已满时任务延后重新入队
+)
+
+// PlanQuota 套餐额度
+type PlanQuota struct {
+	TasksPerDay  int64 // 每天创建的下载任务数，播放列表按条目计
+	Concurrent   int64 // 同时进行的下载和推流
+	MonthlyBytes int64 // 每月下载的字节数，命中媒体缓存的不计
+}
+
+var planQuotas = map[string]PlanQuota{
+	models.PlanFree:  {TasksPerDay: 20, Concurrent: 1, MonthlyBytes: 10 << 30},
+	models.PlanPro:   {TasksPerDay: 200, Concurrent: 3, MonthlyBytes: 200 << 30},
+	models.PlanUltra: {TasksPerDay: 1000, Concurrent: 5, MonthlyBytes: 1 << 40},
+}
+
+// PlanQuotaFor 未知套餐按免费套餐处理
+func PlanQuotaFor(plan string) PlanQuota {
+	if q, ok := planQuotas[plan]; ok {
+		return q
+	}
+	return planQuotas[models.PlanFree]
+}
+
+// QuotaCounter 一项额度的用量
+type QuotaCounter struct {
+	Used      int64      `json:"used"`
+	Limit     int64      `json:"limit"`
+	Remaining int64      `json:"remaining"`
+	ResetAt   *time.Time `json:"reset_at,omitempty"` // concurrent slots free up as downloads finish
+}
+
+func newQuotaCounter(used, limit int64, resetAt *time.Time) QuotaCounter {
+	return QuotaCounter{Used: used, Limit: limit, Remaining: max(limit-used, 0), ResetAt: resetAt}
+}
+
+// QuotaError 超出套餐额度，接口返回 429
+type QuotaError struct {
+	Quota string `json:"quota"`
+	QuotaCounter
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded (%d/%d)", e.Quota, e.Used, e.Limit)
+}
+
+// QuotaUsage GET /api/me 中的当前用量
+type QuotaUsage struct {
+	Plan         string       `json:"plan"`
+	TasksPerDay  QuotaCounter `json:"tasks_per_day"`
+	Concurrent   QuotaCounter `json:"concurrent"`
+	MonthlyBytes QuotaCounter `json:"monthly_bytes"`
+}
+
+// 按服务器本地时间的自然日、自然月重置
+func dayReset(now time.Time) time.Time {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+}
+
+func monthReset(now time.Time) time.Time {
+	y, m, _ := now.Date()
+	return time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location())
+}
+
+func tasksQuotaKey(userID uint, now time.Time) string {
+	return fmt.Sprintf("quota:tasks:%d:%s", userID, now.Format("20060102"))
+}
+
+func bytesQuotaKey(userID uint, now time.Time) string {
+	return fmt.Sprintf("quota:bytes:%d:%s", userID, now.Format("200601"))
+}
+
+func slotsQuotaKey(userID uint) string {
+	return "quota:running:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+// GetQuotaUsage 读取各项用量，Redis 出错时返回错误
+func GetQuotaUsage(u *models.User) (*QuotaUsage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quotaTimeout)
+	defer cancel()
+	limits := PlanQuotaFor(u.Plan)
+	now := time.Now()
+	tasks, err := dao.QuotaGet(ctx, tasksQuotaKey(u.ID, now))
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := dao.QuotaGet(ctx, bytesQuotaKey(u.ID, now))
+	if err != nil {
+		return nil, err
+	}
+	running, err := dao.QuotaSlots(ctx, slotsQuotaKey(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	day, month := dayReset(now), monthReset(now)
+	return &QuotaUsage{
+		Plan:         u.Plan,
+		TasksPerDay:  newQuotaCounter(tasks, limits.TasksPerDay, &day),
+		Concurrent:   newQuotaCounter(running, limits.Concurrent, nil),
+		MonthlyBytes: newQuotaCounter(bytes, limits.MonthlyBytes, &month),
+	}, nil
+}
+
+// consumeTaskQuota 创建任务前扣减当天的任务数，并确认本月流量还有剩余。
+// 额度检查失败（Redis 不可用）时放行，不影响正常使用；返回的函数用于创建失败时退还
+func consumeTaskQuota(u *models.User, n int) (refund func(), err error) {
+	refund = func() {}
+	ctx, cancel := context.WithTimeout(context.Background(), quotaTimeout)
+	defer cancel()
+	limits := PlanQuotaFor(u.Plan)
+	now := time.Now()
+	if err := checkBytesQuota(ctx, u.ID, limits, now); err != nil {
+		return refund, err
+	}
+	key, reset := tasksQuotaKey(u.ID, now), dayReset(now)
+	ok, used, err := dao.QuotaConsume(ctx, key, int64(n), limits.TasksPerDay, reset)
+	if err != nil {
+		log.Error("consume task quota user:%d err:%v", u.ID, err)
+		return refund, nil
+	}
+	if !ok {
+		return refund, &QuotaError{Quota: QuotaTasksPerDay, QuotaCounter: newQuotaCounter(used, limits.TasksPerDay, &reset)}
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), quotaTimeout)
+		defer cancel()
+		if _, err := dao.QuotaAdd(ctx, key, -int64(n), reset); err != nil {
+			log.Error("refund task quota user:%d err:%v", u.ID, err)
+		}
+	}, nil
+}
+
+// checkTaskQuota 只检查不扣减，解析链接前先确认当天任务数和本月流量还有剩余
+func checkTaskQuota(u *models.User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), quotaTimeout)
+	defer cancel()
+	limits := PlanQuotaFor(u.Plan)
+	now := time.Now()
+	if err := checkBytesQuota(ctx, u.ID, limits, now); err != nil {
+		return err
+	}
+	used, err := dao.QuotaGet(ctx, tasksQuotaKey(u.ID, now))
+	if err != nil {
+		log.Error("get task quota user:%d err:%v", u.ID, err)
+		return nil
+	}
+	if used >= limits.TasksPerDay {
+		reset := dayReset(now)
+		return &QuotaError{Quota: QuotaTasksPerDay, QuotaCounter: newQuotaCounter(used, limits.TasksPerDay, &reset)}
+	}
+	return nil
+}
+
+func checkBytesQuota(ctx context.Context, userID uint, limits PlanQuota, now time.Time) error {
+	used, err := dao.QuotaGet(ctx, bytesQuotaKey(userID, now))
+	if err != nil {
+		log.Error("get bytes quota user:%d err:%v", userID, err)
+		return nil
+	}
+	if used >= limits.MonthlyBytes {
+		reset := monthReset(now)
+		return &QuotaError{Quota: QuotaMonthlyBytes, QuotaCounter: newQuotaCounter(used, limits.MonthlyBytes, &reset)}
+	}
+	return nil
+}
+
+// addBytesUsage 下载或推流结束后累计流量。按任务只计一次：推流和队列下载同一任务时取较大的一次
+func addBytesUsage(userID, taskID uint, n int64) {
+	if n <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), quotaTimeout)
+	defer cancel()
+	now := time.Now()
+	key := bytesQuotaKey(userID, now)
+	// 多保留一天，月初仍能查到上月用量
+	if _, err := dao.QuotaAddTaskBytes(ctx, key, key+":task:"+strconv.FormatUint(uint64(taskID), 10), n,
+		monthReset(now).Add(24*time.Hour)); err != nil {
+		log.Error("add bytes usage user:%d task:%d err:%v", userID, taskID, err)
+	}
+}
+
+// acquireDownloadSlot 开始下载或推流前确认本月流量并占用并发名额，返回释放名额的函数。
+// member 区分同一用户的不同下载，推流和队列下载各有一个 yt-dlp 进程，各占一个名额；下载期间定时续约
+func acquireDownloadSlot(userID uint, member string) (release func(), err error) {
+	release = func() {}
+	u, err := dao.GetUserById(int64(userID))
+	if err != nil {
+		return release, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), quotaTimeout)
+	defer cancel()
+	limits := PlanQuotaFor(u.Plan)
+	if err := checkBytesQuota(ctx, userID, limits, time.Now()); err != nil {
+		return release, err
+	}
+	key := slotsQuotaKey(userID)
+	ok, running, err := dao.QuotaAcquireSlot(ctx, key, member, limits.Concurrent, slotLease)
+	if err != nil {
+		log.Error("acquire download slot user:%d err:%v", userID, err)
+		return release, nil
+	}
+	if !ok {
+		return release, &QuotaError{Quota: QuotaConcurrent, QuotaCounter: newQuotaCounter(running, limits.Concurrent, nil)}
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(slotRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), quotaTimeout)
+				if err := dao.QuotaRefreshSlot(ctx, key, member, slotLease); err != nil {
+					log.Error("refresh download slot user:%d err:%v", userID, err)
+				}
+				cancel()
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		ctx, cancel := context.WithTimeout(context.Background(), quotaTimeout)
+		defer cancel()
+		if err := dao.QuotaReleaseSlot(ctx, key, member); err != nil {
+			log.Error("release download slot user:%d err:%v", userID, err)
+		}
+	}, nil
+}
+
+// IsConcurrentQuota 并发已满，稍后可以重试
+func IsConcurrentQuota(err error) bool {
+	var qe *QuotaError
+	return errors.As(err, &qe) && qe.Quota == QuotaConcurrent
+}
@@ -6,11 +6,17 @@ import (
 	"fmt"
 	"minodl/dao"
 	"minodl/models"
+	"minodl/storage"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// 预约下载最多提前的时间
+const maxScheduleAhead = 30 * 24 * time.Hour
+
+var ErrScheduleTooFar = errors.New("not_before must be within 30 days")
+
 // Auth
 func CreateUser(email, password string) (*models.User, error) {
 	// validate omitted
@@ -36,29 +42,105 @@ func Authenticate(email, password string) (*models.User, error) {
 	return u, nil
 }
 
+// TaskOptions 创建任务时的可选参数
+type TaskOptions struct {
+	Format  string // format_id 或清晰度标签（1080p、audio、best）
+	Profile string // 后处理配置名，见 Profiles()
+	Entries []int  // 播放列表中要下载的条目序号，为空时全部下载
+	// 要下载的字幕，为空时不下载
+	Subtitles *SubtitleOptions
+	// 预约下载，到时间后才入队
+	NotBefore *time.Time
+	// 由订阅创建的任务
+	SubscriptionID uint
+}
+
 // Tasks
-func CreateTaskForUser(userID uint, sourceURL string) (*models.Task, error) {
-	videoInfo, err := ParseVideoInfo(sourceURL)
+func CreateTaskForUser(userID uint, sourceURL string, opts TaskOptions) (*models.Task, error) {
+	if opts.NotBefore != nil && time.Until(*opts.NotBefore) > maxScheduleAhead {
+		return nil, ErrScheduleTooFar
+	}
+	u, err := dao.GetUserById(int64(userID))
+	if err != nil {
+		return nil, err
+	}
+	// 额度已经用完时不必再解析链接，真正扣减在创建任务时
+	if err = checkTaskQuota(u); err != nil {
+		return nil, err
+	}
+	// 任务记录规范地址，分享文案和短链在这里解析
+	sourceURL, err = ResolveShareURL(context.Background(), sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	videoInfo, err := ParseVideoInfo(userID, sourceURL)
 	if err != nil {
 		return nil, err
 	}
+	format := opts.Format
+	if opts.Profile != "" {
+		profile, ok := GetProfile(opts.Profile)
+		if !ok {
+			return nil, errors.New("unknown profile: " + opts.Profile)
+		}
+		// 只要音频时不必下载视频流
+		if profile.AudioOnly && format == "" {
+			format = FormatAudio
+		}
+	}
+	spec, err := ResolveFormat(format, videoInfo.Qualities, PlanMaxHeight(u.Plan))
+	if err != nil {
+		return nil, err
+	}
+	if videoInfo.IsPlaylist {
+		opts.Format = format
+		return createPlaylistTask(u, sourceURL, videoInfo, spec, opts)
+	}
 	t := &models.Task{
-		UserID:    userID,
-		Title:     videoInfo.Title,
-		SourceURL: sourceURL,
-		Status:    models.StatusPending,
-		Progress:  "0",
+		UserID:         userID,
+		Title:          videoInfo.Title,
+		SourceURL:      sourceURL,
+		Status:         models.StatusPending,
+		Priority:       planPriority(u.Plan),
+		Format:         format,
+		FormatSpec:     spec,
+		Duration:       videoInfo.Duration,
+		Profile:        opts.Profile,
+		NotBefore:      opts.NotBefore,
+		SubscriptionID: opts.SubscriptionID,
+	}
+	if err = applySubtitleOptions(t, opts.Subtitles, videoInfo.Subtitles); err != nil {
+		return nil, err
+	}
+	t.CacheKey = mediaCacheKey(videoInfo.Extractor, videoInfo.VideoID, sourceURL, spec, cacheVariant(t))
+	// 已缓存的内容直接完成
+	entry := lookupMediaCache(context.Background(), t.CacheKey)
+	if entry != nil {
+		applyMediaCache(t, entry)
+	}
+	refund, err := consumeTaskQuota(u, 1)
+	if err != nil {
+		if entry != nil {
+			_ = dao.ReleaseMediaCache(entry.ID)
+		}
+		return nil, err
 	}
 	if err := dao.CreateTask(t); err != nil {
+		refund()
+		if entry != nil {
+			_ = dao.ReleaseMediaCache(entry.ID)
+		}
 		return nil, err
 	}
-	t.VideoURL = fmt.Sprintf("/tasks/%d/stream", t.ID)
-	_ = dao.UpdateTask(t)
+	if entry == nil && Queue != nil {
+		Queue.Schedule(t)
+	}
 	return t, nil
 }
 
-func ListTasks(userID uint) ([]models.Task, error) {
-	return dao.ListTasksByUser(userID)
+// ListTasks parentID 为 0 时列出顶层任务，否则列出该播放列表的子任务
+func ListTasks(userID uint, parentID uint) ([]models.Task, error) {
+	return dao.ListTasksByUser(userID, parentID)
 }
 
 func GetTask(userID uint, id uint) (*models.Task, error) {
@@ -72,46 +154,184 @@ func GetTask(userID uint, id uint) (*models.Task, error) {
 	return t, nil
 }
 
-func StartDownloadTask(ctx context.Context, t *models.Task) error {
-	// NOTE: Real download/parse logic should be implemented by user.
-	// Here we simulate background progress with a goroutine and update DB.
-	if t.Status == models.StatusRunning {
+// ResolveURLs 读取时把存储 key 解析为客户端可访问的地址，只用于响应，不要再保存
+func ResolveURLs(t *models.Task) {
+	if t.Status == models.StatusCompleted && t.FilePath != "" {
+		key := t.FilePath
+		if t.ProcessedPath != "" {
+			key = t.ProcessedPath
+		}
+		if u := storage.Store.URL(key); u != "" {
+			t.VideoURL = u
+			return
+		}
+		t.VideoURL = fmt.Sprintf("/api/tasks/%d/download", t.ID)
+		return
+	}
+	t.VideoURL = fmt.Sprintf("/api/tasks/%d/stream", t.ID)
+}
+
+// StartDownloadTask 把任务放回下载队列，失败的任务可以重新开始
+func StartDownloadTask(t *models.Task) error {
+	if Queue == nil {
+		return errors.New("download queue not started")
+	}
+	if t.ChildCount > 0 {
+		return restartChildren(t)
+	}
+	switch t.Status {
+	case models.StatusRunning:
 		return errors.New("already running")
+	case models.StatusCompleted:
+		return errors.New("already completed")
+	}
+	resetProgress(t)
+	t.ErrorMsg = ""
+	t.ErrorCode = ""
+	t.NextRetryAt = nil
+	// 手动开始的预约任务立即下载
+	t.NotBefore = nil
+	t.ProfileStatus = ""
+	t.ProfileProgress = 0
+	if err := NewTaskTracker(t).SetStatus(models.StatusPending); err != nil {
+		return err
 	}
-	t.Status = models.StatusRunning
-	_ = dao.UpdateTask(t)
+	Queue.Push(t)
+	return nil
+}
 
-	go func(taskID uint) {
-		// Simulate work
-		for i := 1; i <= 10; i++ {
-			time.Sleep(1 * time.Second)
-			tt, err := dao.GetTaskByID(taskID)
-			if err != nil {
-				return
+// CancelTask 取消等待中或执行中的任务，无论进程在哪个 dl 节点
+func CancelTask(userID uint, id uint) (*models.Task, error) {
+	t, err := GetTask(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if t.Status != models.StatusPending && t.Status != models.StatusRunning {
+		return nil, errors.New("task is not active")
+	}
+	if t.ChildCount > 0 {
+		children, err := dao.ListChildTasks(t.ID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range children {
+			if children[i].Status == models.StatusPending || children[i].Status == models.StatusRunning {
+				if _, err = cancelTask(&children[i]); err != nil {
+					return nil, err
+				}
 			}
-			tt.Progress = fmt.Sprintf("%.2f", float32(i)/10.0)
-			_ = dao.UpdateTask(tt)
 		}
-		// After simulated download, mark completed and set a fake file path / video url
-		tt, _ := dao.GetTaskByID(taskID)
-		tt.Status = models.StatusCompleted
-		tt.Progress = "100"
-		tt.FilePath = fmt.Sprintf("/data/videos/%d.mp4", tt.ID)                   // TODO: change to real storage path
-		tt.VideoURL = fmt.Sprintf("https://cdn.example.com/videos/%d.mp4", tt.ID) // TODO: actual CDN or signed URL
-		_ = dao.UpdateTask(tt)
-	}(t.ID)
+	}
+	ok, err := cancelTask(t)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// 播放列表的状态由子任务汇总，可能已随子任务结束
+		if t.ChildCount > 0 {
+			return GetTask(userID, id)
+		}
+		return nil, errors.New("task is not active")
+	}
+	return t, nil
+}
+
+// cancelTask 只取消仍在进行的任务（statuses 可以进一步限定），任务已结束时返回 false。状态先按条件落库，
+// 队列认领和下载进程写进度时都会发现；事件广播后持有进程的节点立即终止
+func cancelTask(t *models.Task, statuses ...models.TaskStatus) (bool, error) {
+	ok, err := dao.CancelTask(t.ID, statuses...)
+	if err != nil || !ok {
+		return ok, err
+	}
+	t.Status = models.StatusCancelled
+	t.ErrorMsg = ""
+	t.Speed = 0
+	t.ETA = 0
+	tracker := NewTaskTracker(t)
+	Events.Publish(tracker.event(EventStatus))
+	tracker.refreshParent()
+	return true, nil
+}
 
+// DeleteTask 删除已结束的任务并释放媒体缓存引用，播放列表连同子任务一起删除
+func DeleteTask(userID uint, id uint) error {
+	t, err := GetTask(userID, id)
+	if err != nil {
+		return err
+	}
+	tasks := []models.Task{*t}
+	if t.ChildCount > 0 {
+		children, err := dao.ListChildTasks(t.ID)
+		if err != nil {
+			return err
+		}
+		tasks = append(tasks, children...)
+	}
+	ids := make([]uint, 0, len(tasks))
+	for _, task := range tasks {
+		if task.Status == models.StatusPending || task.Status == models.StatusRunning {
+			return errors.New("cancel the task before deleting it")
+		}
+		ids = append(ids, task.ID)
+	}
+	if err = dao.DeleteTasks(ids); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		Events.Forget(id)
+		if Queue != nil {
+			Queue.Remove(id)
+		}
+	}
+	for i := range tasks {
+		releaseTaskMedia(context.Background(), &tasks[i])
+	}
+	if t.ParentID != 0 {
+		refreshParent(t.ParentID)
+	}
 	return nil
 }
 
-func MarkComplete(taskID uint, filePath, videoURL string) error {
-	t, err := dao.GetTaskByID(taskID)
+// RetryTask 手动重试失败或取消的任务，重置自动重试次数
+func RetryTask(userID uint, id uint) (*models.Task, error) {
+	t, err := GetTask(userID, id)
 	if err != nil {
+		return nil, err
+	}
+	if t.ChildCount == 0 && t.Status != models.StatusFailed && t.Status != models.StatusCancelled {
+		return nil, errors.New("only failed or cancelled tasks can be retried")
+	}
+	t.Attempts = 0
+	if err = StartDownloadTask(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// restartChildren 重新下载播放列表中失败或取消的条目
+func restartChildren(parent *models.Task) error {
+	children, err := dao.ListChildTasks(parent.ID)
+	if err != nil {
+		return err
+	}
+	var restart []*models.Task
+	for i := range children {
+		if children[i].Status == models.StatusFailed || children[i].Status == models.StatusCancelled {
+			restart = append(restart, &children[i])
+		}
+	}
+	if len(restart) == 0 {
+		return errors.New("no failed entries to restart")
+	}
+	// 已结束的父任务先恢复为进行中，否则子任务的汇总不会再写入
+	if err = dao.ReopenTask(parent.ID); err != nil {
 		return err
 	}
-	t.Status = models.StatusCompleted
-	t.Progress = "100"
-	t.FilePath = filePath
-	t.VideoURL = videoURL
-	return dao.UpdateTask(t)
+	for _, child := range restart {
+		child.Attempts = 0
+		if err = StartDownloadTask(child); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"minodl/dao"
+	"minodl/log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	maxShortLinkHops  = 5
+	shortLinkTimeout  = 10 * time.Second
+	shortLinkCacheTTL = 24 * time.Hour
+	shortLinkPrefix   = "short:"
+)
+
+var (
+	ErrNoShareURL = errors.New("no url found in share text")
+	ErrShortLink  = errors.New("short link did not resolve")
+
+	shareURLRe = regexp.MustCompile(`(?i)https?://[^\s"'<>()\[\]{}，。！？、；：“”‘’（）【】《》]+`)
+
+	// 短链跳转只取 Location，不跟随到最终页面
+	shortLinkClient = &http.Client{
+		Timeout: shortLinkTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	youtubeShortsRe = regexp.MustCompile(`^/shorts/([\w-]{11})`)
+	douyinShareRe   = regexp.MustCompile(`^/share/(video|note|slides)/(\d+)`)
+	xhsItemRe       = regexp.MustCompile(`^/discovery/item/([0-9a-f]{24})`)
+)
+
+// 需要跳转才能得到作品地址的短链域名
+var shortLinkHosts = []string{"b23.tv", "v.douyin.com", "xhslink.com"}
+
+// 各站点规范地址保留的参数，其它参数都是分享来源、设备等统计信息
+var keptParams = map[string][]string{
+	YouTube:  {"v", "list"},
+	BILIBILI: {"p"},
+	DouYin:   {"modal_id"},
+	XHS:      {"xsec_token"}, // 网页版打开笔记需要
+}
+
+// ResolveShareURL 从分享文案中取出第一个支持的链接，短链跟随跳转，再转换成规范地址。
+// 解析、缓存和任务都使用规范地址，同一作品的不同分享链接得到相同结果
+func ResolveShareURL(ctx context.Context, text string) (string, error) {
+	raw, ok := extractShareURL(text)
+	if !ok {
+		return "", ErrNoShareURL
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if isShortLink(u.Hostname()) {
+		if u, err = followShortLink(ctx, u); err != nil {
+			return "", err
+		}
+	}
+	return canonicalURL(u), nil
+}
+
+// extractShareURL 文案中有多个链接时优先取已知站点的
+func extractShareURL(text string) (string, bool) {
+	matches := shareURLRe.FindAllString(text, -1)
+	if len(matches) == 0 {
+		return "", false
+	}
+	for i, m := range matches {
+		// 中英文句末标点不属于链接
+		matches[i] = strings.TrimRight(m, ".,;:!?~")
+	}
+	for _, m := range matches {
+		if u, err := url.Parse(m); err == nil && knownSite(u.Hostname()) {
+			return m, true
+		}
+	}
+	return matches[0], true
+}
+
+func knownSite(host string) bool {
+	host = strings.ToLower(host)
+	if isShortLink(host) {
+		return true
+	}
+	extractors.RLock()
+	defer extractors.RUnlock()
+	for h := host; h != ""; {
+		if _, ok := extractors.routes[h]; ok {
+			return true
+		}
+		_, h, _ = strings.Cut(h, ".")
+	}
+	return false
+}
+
+func isShortLink(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range shortLinkHosts {
+		if domainMatch(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// followShortLink 逐跳读取 Location，离开短链域名即停止；重复出现的地址视为循环
+func followShortLink(ctx context.Context, u *url.URL) (*url.URL, error) {
+	start := u.String()
+	if cached, err := dao.CacheGet(ctx, shortLinkPrefix+start); err == nil && cached != "" {
+		if target, err := url.Parse(cached); err == nil {
+			return target, nil
+		}
+	}
+	seen := map[string]bool{}
+	for hop := 0; isShortLink(u.Hostname()); hop++ {
+		if hop >= maxShortLinkHops {
+			return nil, fmt.Errorf("%w: too many redirects", ErrShortLink)
+		}
+		if seen[u.String()] {
+			return nil, fmt.Errorf("%w: redirect loop at %s", ErrShortLink, u)
+		}
+		seen[u.String()] = true
+		next, err := shortLinkLocation(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		u = next
+	}
+	if err := dao.CacheSet(ctx, shortLinkPrefix+start, u.String(), shortLinkCacheTTL); err != nil {
+		log.Error("cache short link %s err:%v", start, err)
+	}
+	return u, nil
+}
+
+func shortLinkLocation(ctx context.Context, u *url.URL) (*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// 抖音短链对桌面浏览器返回的是网页而不是跳转
+	req.Header.Set("User-Agent", mobileUA)
+	resp, err := shortLinkClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	loc := resp.Header.Get("Location")
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 || loc == "" {
+		return nil, fmt.Errorf("%w: %s returned %d", ErrShortLink, u, resp.StatusCode)
+	}
+	next, err := u.Parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	if next.Scheme != "http" && next.Scheme != "https" {
+		return nil, fmt.Errorf("%w: unsupported redirect %s", ErrShortLink, loc)
+	}
+	return next, nil
+}
+
+// canonicalURL 移动端、分享页域名换成网页版地址，只保留决定内容的参数
+func canonicalURL(u *url.URL) string {
+	host := strings.ToLower(u.Hostname())
+	path := u.Path
+	q := u.Query()
+	switch {
+	case host == "youtu.be":
+		if id := strings.Trim(path, "/"); id != "" {
+			host, path = "www."+YouTube, "/watch"
+			q.Set("v", id)
+		}
+	case domainMatch(host, YouTube) && host != "music."+YouTube:
+		host = "www." + YouTube
+		if m := youtubeShortsRe.FindStringSubmatch(path); m != nil {
+			path = "/watch"
+			q.Set("v", m[1])
+		}
+	case domainMatch(host, BILIBILI) && (host == "m."+BILIBILI || host == BILIBILI):
+		host = "www." + BILIBILI
+	case domainMatch(host, "iesdouyin.com") || domainMatch(host, DouYin):
+		if m := douyinShareRe.FindStringSubmatch(path); m != nil {
+			kind := m[1]
+			if kind == "slides" {
+				kind = "note"
+			}
+			host, path = "www."+DouYin, "/"+kind+"/"+m[2]
+		} else if domainMatch(host, DouYin) {
+			host = "www." + DouYin
+		}
+	case domainMatch(host, XHS):
+		host = "www." + XHS
+		if m := xhsItemRe.FindStringSubmatch(path); m != nil {
+			path = "/explore/" + m[1]
+		}
+	}
+	out := &url.URL{Scheme: "https", Host: host, Path: path}
+	if site := siteOf(host); site != "" {
+		kept := url.Values{}
+		for _, k := range keptParams[site] {
+			if v := q.Get(k); v != "" {
+				kept.Set(k, v)
+			}
+		}
+		q = kept
+	} else {
+		for k := range q {
+			if strings.HasPrefix(k, "utm_") || trackingParams[k] {
+				q.Del(k)
+			}
+		}
+	}
+	out.RawQuery = q.Encode()
+	return out.String()
+}
+
+// siteOf host 所属的已知站点
+func siteOf(host string) string {
+	for site := range keptParams {
+		if domainMatch(host, site) {
+			return site
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"minodl/config"
+	"minodl/models"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	SignedStream   = "stream"
+	SignedDownload = "download"
+	SignedHLS      = "hls"
+
+	DefaultSignedTTL = 30 * time.Minute
+	MaxSignedTTL     = 24 * time.Hour
+)
+
+var (
+	ErrSignature = errors.New("invalid signature")
+	ErrExpired   = errors.New("link expired")
+)
+
+// SignedURL 播放器、系统下载器无法携带鉴权头，用短期签名链接代替
+type SignedURL struct {
+	URL       string `json:"url"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func signSecret() []byte {
+	if secret := config.Get().SignSecret; secret != "" {
+		return []byte(secret)
+	}
+	return []byte(config.Get().JWTSecret)
+}
+
+func urlSignature(action string, taskID, userID uint, exp int64) string {
+	mac := hmac.New(sha256.New, signSecret())
+	_, _ = fmt.Fprintf(mac, "%s:%d:%d:%d", action, taskID, userID, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignTaskURL 为用户自己的任务签发链接，action: stream | download | hls
+func SignTaskURL(userID, taskID uint, action string, ttl time.Duration) (*SignedURL, error) {
+	if action != SignedStream && action != SignedDownload && action != SignedHLS {
+		return nil, errors.New("unknown action")
+	}
+	if _, err := GetTask(userID, taskID); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = DefaultSignedTTL
+	}
+	if ttl > MaxSignedTTL {
+		ttl = MaxSignedTTL
+	}
+	exp := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("uid", strconv.FormatUint(uint64(userID), 10))
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", urlSignature(action, taskID, userID, exp))
+	target := action
+	// hls 的签名对整个切片目录有效，换成 ts/index.m3u8 也可以
+	if action == SignedHLS {
+		target = "hls/" + HLSFMP4 + "/" + HLSPlaylist
+	}
+	return &SignedURL{
+		URL:       fmt.Sprintf("/s/tasks/%d/%s?%s", taskID, target, q.Encode()),
+		ExpiresAt: exp,
+	}, nil
+}
+
+// VerifyTaskURL 校验签名和有效期，再按 GetTask 的规则检查任务归属
+func VerifyTaskURL(taskID uint, action, uid, exp, sig string) (*models.Task, error) {
+	userID, err := strconv.ParseUint(uid, 10, 64)
+	if err != nil {
+		return nil, ErrSignature
+	}
+	expAt, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return nil, ErrSignature
+	}
+	expected := urlSignature(action, taskID, uint(userID), expAt)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return nil, ErrSignature
+	}
+	if time.Now().Unix() > expAt {
+		return nil, ErrExpired
+	}
+	return GetTask(uint(userID), taskID)
+}
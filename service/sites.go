@@ -0,0 +1,101 @@
+package service
+
+import (
+	"minodl/models"
+	"sort"
+	"strconv"
+)
+
+// 没有路由的域名在站点列表中的写法
+const otherSites = "*"
+
+// SiteInfo 一个支持的站点，由后端路由和后端声明的能力生成
+type SiteInfo struct {
+	Domain        string            `json:"domain"`
+	Aliases       []string          `json:"aliases,omitempty"` // short links and share pages of the same site
+	Extractors    []string          `json:"extractors"`        // tried in order
+	Playlists     bool              `json:"playlists"`
+	Subtitles     bool              `json:"subtitles"`
+	AudioOnly     bool              `json:"audio_only"`
+	Images        bool              `json:"images"`
+	LoginRequired bool              `json:"login_required"`
+	LoginCookies  []string          `json:"login_cookies,omitempty"` // cookies an uploaded cookie file must contain
+	MaxQuality    map[string]string `json:"max_quality"`             // plan -> quality label, "best" means unlimited
+}
+
+// Sites 按当前路由列出支持的站点，别名域名合并到主站点，最后一项是其它站点的通用后端。
+// 能力取链上第一个后端的，回退只在它失败时发生
+func Sites() []SiteInfo {
+	extractors.RLock()
+	chains := map[string][]string{}
+	aliases := map[string][]string{}
+	for domain, names := range extractors.routes {
+		site := domain
+		if main, ok := siteAliases[domain]; ok {
+			site = main
+			aliases[site] = append(aliases[site], domain)
+		}
+		if _, ok := chains[site]; !ok || site == domain {
+			chains[site] = names
+		}
+	}
+	chains[otherSites] = extractors.defaultChain
+	byName := make(map[string]Extractor, len(extractors.byName))
+	for name, e := range extractors.byName {
+		byName[name] = e
+	}
+	extractors.RUnlock()
+
+	out := make([]SiteInfo, 0, len(chains))
+	for site, names := range chains {
+		info := SiteInfo{Domain: site, Extractors: []string{}, LoginCookies: loginCookies[site]}
+		var caps *Capabilities
+		for _, name := range names {
+			e, ok := byName[name]
+			if !ok {
+				continue
+			}
+			info.Extractors = append(info.Extractors, name)
+			if caps == nil {
+				c := e.Capabilities(site)
+				caps = &c
+			}
+		}
+		if caps == nil {
+			continue
+		}
+		sort.Strings(aliases[site])
+		info.Aliases = aliases[site]
+		info.Playlists = caps.Playlists
+		info.Subtitles = caps.Subtitles
+		info.AudioOnly = caps.AudioOnly
+		info.Images = caps.Images
+		info.LoginRequired = caps.LoginRequired
+		info.MaxQuality = planQualities(caps.MaxHeight)
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if (out[i].Domain == otherSites) != (out[j].Domain == otherSites) {
+			return out[j].Domain == otherSites
+		}
+		return out[i].Domain < out[j].Domain
+	})
+	return out
+}
+
+// planQualities 各套餐在站点上的最高清晰度：套餐上限和站点上限取较小的
+func planQualities(siteMax int) map[string]string {
+	out := make(map[string]string, len(planMaxHeight))
+	for _, plan := range []string{models.PlanFree, models.PlanPro, models.PlanUltra} {
+		h := PlanMaxHeight(plan)
+		if h == 0 || (siteMax > 0 && siteMax < h) {
+			h = siteMax
+		}
+		if h == 0 {
+			out[plan] = FormatBest
+			continue
+		}
+		out[plan] = strconv.Itoa(h) + "p"
+	}
+	return out
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/models"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	minPollInterval     = 15 * time.Minute
+	defaultPollInterval = time.Hour
+	subscriptionSweep   = time.Minute
+	subscriptionBatch   = 20 // 每轮最多拉取的订阅数
+	maxNewPerPoll       = 10 // 每次拉取最多创建的任务，其余留到下次
+	subscriptionTimeout = 2 * time.Minute
+)
+
+var (
+	ErrSubscriptionSource = errors.New("subscription url must be a channel or playlist")
+	ErrSubscriptionInput  = errors.New("invalid subscription settings")
+
+	// 频道首页是标签页列表，订阅时改为“视频”标签
+	youtubeChannelRe = regexp.MustCompile(`^/(@[^/]+|channel/[\w-]+|c/[^/]+|user/[^/]+)/?$`)
+)
+
+// SubscriptionInput 创建订阅的参数
+type SubscriptionInput struct {
+	URL          string `json:"url"`
+	PollInterval int    `json:"poll_interval"` // seconds, at least 900, default 3600
+	Keyword      string `json:"keyword"`
+	MaxDuration  int    `json:"max_duration"` // seconds, 0 for no limit
+	Format       string `json:"format"`       // best, audio or a quality label such as 1080p
+}
+
+// SubscriptionUpdate 修改订阅，只修改非空字段
+type SubscriptionUpdate struct {
+	PollInterval *int    `json:"poll_interval"`
+	Keyword      *string `json:"keyword"`
+	MaxDuration  *int    `json:"max_duration"`
+	Format       *string `json:"format"`
+	Enabled      *bool   `json:"enabled"`
+}
+
+// CreateSubscription 校验链接是频道或播放列表，并把当前已有的作品记为见过，之后只下载新发布的
+func CreateSubscription(userID uint, in SubscriptionInput) (*models.Subscription, error) {
+	if in.PollInterval == 0 {
+		in.PollInterval = int(defaultPollInterval.Seconds())
+	}
+	if err := validateSubscription(userID, in.PollInterval, in.MaxDuration, in.Format); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), subscriptionTimeout)
+	defer cancel()
+	sourceURL, err := ResolveShareURL(ctx, in.URL)
+	if err != nil {
+		return nil, err
+	}
+	sourceURL = subscriptionURL(sourceURL)
+	info, err := probeSource(ctx, userID, sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	if info.Type != "playlist" {
+		return nil, ErrSubscriptionSource
+	}
+	now := time.Now()
+	s := &models.Subscription{
+		UserID:       userID,
+		SourceURL:    sourceURL,
+		Title:        info.Title,
+		PollInterval: in.PollInterval,
+		Keyword:      strings.TrimSpace(in.Keyword),
+		MaxDuration:  in.MaxDuration,
+		Format:       in.Format,
+		Enabled:      true,
+		NextPollAt:   now.Add(time.Duration(in.PollInterval) * time.Second),
+		LastPolledAt: &now,
+	}
+	if err = dao.CreateSubscription(s); err != nil {
+		return nil, err
+	}
+	entries := playlistEntries(info.Entries)
+	seen := make([]models.SubscriptionEntry, 0, len(entries))
+	for _, e := range entries {
+		seen = append(seen, models.SubscriptionEntry{SubscriptionID: s.ID, VideoID: entryVideoID(e)})
+	}
+	if err = dao.AddSubscriptionEntries(seen); err != nil {
+		log.Error("archive subscription:%d entries err:%v", s.ID, err)
+	}
+	return s, nil
+}
+
+func ListSubscriptions(userID uint) ([]models.Subscription, error) {
+	return dao.ListSubscriptions(userID)
+}
+
+// UpdateSubscription 修改拉取间隔后从现在起重新计时
+func UpdateSubscription(userID, id uint, in SubscriptionUpdate) (*models.Subscription, error) {
+	s, err := dao.GetSubscription(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{}
+	if in.PollInterval != nil && *in.PollInterval != s.PollInterval {
+		s.PollInterval = *in.PollInterval
+		s.NextPollAt = time.Now().Add(time.Duration(s.PollInterval) * time.Second)
+		updates["poll_interval"] = s.PollInterval
+		updates["next_poll_at"] = s.NextPollAt
+	}
+	if in.Keyword != nil {
+		s.Keyword = strings.TrimSpace(*in.Keyword)
+		updates["keyword"] = s.Keyword
+	}
+	if in.MaxDuration != nil {
+		s.MaxDuration = *in.MaxDuration
+		updates["max_duration"] = s.MaxDuration
+	}
+	if in.Format != nil {
+		s.Format = *in.Format
+		updates["format"] = s.Format
+	}
+	if in.Enabled != nil {
+		s.Enabled = *in.Enabled
+		updates["enabled"] = s.Enabled
+	}
+	if len(updates) == 0 {
+		return s, nil
+	}
+	if err = validateSubscription(userID, s.PollInterval, s.MaxDuration, s.Format); err != nil {
+		return nil, err
+	}
+	if err = dao.UpdateSubscription(userID, id, updates); err != nil {
+		return nil, err
+	}
+	s.UpdatedAt = time.Now()
+	return s, nil
+}
+
+func DeleteSubscription(userID, id uint) (bool, error) {
+	return dao.DeleteSubscription(userID, id)
+}
+
+func validateSubscription(userID uint, pollInterval, maxDuration int, format string) error {
+	if time.Duration(pollInterval)*time.Second < minPollInterval {
+		return fmt.Errorf("%w: poll_interval must be at least %d seconds", ErrSubscriptionInput, int(minPollInterval.Seconds()))
+	}
+	if maxDuration < 0 {
+		return fmt.Errorf("%w: max_duration must not be negative", ErrSubscriptionInput)
+	}
+	u, err := dao.GetUserById(int64(userID))
+	if err != nil {
+		return err
+	}
+	// 新作品的 format_id 未知，只接受清晰度标签，且不超过套餐上限
+	if _, err = ResolveFormat(format, nil, PlanMaxHeight(u.Plan)); err != nil {
+		return fmt.Errorf("%w: %v", ErrSubscriptionInput, err)
+	}
+	return nil
+}
+
+// subscriptionURL YouTube 频道首页换成“视频”标签页
+func subscriptionURL(sourceURL string) string {
+	u, err := url.Parse(sourceURL)
+	if err != nil || !domainMatch(strings.ToLower(u.Hostname()), YouTube) {
+		return sourceURL
+	}
+	if youtubeChannelRe.MatchString(u.Path) {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/videos"
+	}
+	return u.String()
+}
+
+// probeSource 不经过解析缓存，每次拉取都看到最新的作品
+func probeSource(ctx context.Context, userID uint, sourceURL string) (*models.VideoInfo, error) {
+	auth, err := siteAuthFor(userID, sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	defer auth.Close()
+	info, err := probeVideo(ctx, sourceURL, auth)
+	if err != nil {
+		return nil, authFailure(auth, err)
+	}
+	credentialUsed(auth)
+	return info, nil
+}
+
+func entryVideoID(e models.PlaylistEntry) string {
+	if e.ID != "" {
+		return e.ID
+	}
+	return normalizeSourceURL(e.URL)
+}
+
+// matchSubscription 标题关键词和时长过滤，时长未知的不过滤
+func matchSubscription(s *models.Subscription, e models.PlaylistEntry) bool {
+	if s.Keyword != "" && !strings.Contains(strings.ToLower(e.Title), strings.ToLower(s.Keyword)) {
+		return false
+	}
+	if s.MaxDuration > 0 && e.Duration > float64(s.MaxDuration) {
+		return false
+	}
+	return true
+}
+
+// pollSubscription 为没见过的作品创建任务。额度不足或临时错误时不记为见过，下次拉取再试
+func pollSubscription(ctx context.Context, s *models.Subscription) (string, error) {
+	info, err := probeSource(ctx, s.UserID, s.SourceURL)
+	if err != nil {
+		return "", err
+	}
+	entries := playlistEntries(info.Entries)
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, entryVideoID(e))
+	}
+	seen, err := dao.SeenSubscriptionVideos(s.ID, ids)
+	if err != nil {
+		return info.Title, err
+	}
+	created := 0
+	var lastErr error
+	// 列表从新到旧，旧的先创建
+	for i := len(entries) - 1; i >= 0 && created < maxNewPerPoll; i-- {
+		e := entries[i]
+		id := entryVideoID(e)
+		if seen[id] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return info.Title, ctx.Err()
+		}
+		entry := models.SubscriptionEntry{SubscriptionID: s.ID, VideoID: id}
+		if matchSubscription(s, e) {
+			t, err := CreateTaskForUser(s.UserID, e.URL, TaskOptions{Format: s.Format, SubscriptionID: s.ID})
+			var qe *QuotaError
+			if errors.As(err, &qe) {
+				return info.Title, err
+			}
+			if err != nil {
+				lastErr = err
+				log.Error("subscription:%d create task for %s err:%v", s.ID, e.URL, err)
+				if IsTransient(ClassifyFailure(err.Error(), err)) {
+					continue
+				}
+			} else {
+				entry.TaskID = t.ID
+				created++
+			}
+		}
+		if err := dao.AddSubscriptionEntries([]models.SubscriptionEntry{entry}); err != nil {
+			return info.Title, err
+		}
+	}
+	if created > 0 {
+		log.Info("subscription:%d created %d tasks", s.ID, created)
+	}
+	return info.Title, lastErr
+}
+
+// InitSubscriptions 定期拉取到期的订阅，多节点通过 ClaimSubscription 分担
+func InitSubscriptions() *Janitor {
+	return startJanitor(subscriptionSweep, func(ctx context.Context) {
+		now := time.Now()
+		due, err := dao.ListDueSubscriptions(now, subscriptionBatch)
+		if err != nil {
+			log.Error("list due subscriptions err:%v", err)
+			return
+		}
+		for i := range due {
+			s := &due[i]
+			next := now.Add(time.Duration(s.PollInterval) * time.Second)
+			claimed, err := dao.ClaimSubscription(s.ID, now, next)
+			if err != nil {
+				log.Error("claim subscription:%d err:%v", s.ID, err)
+				continue
+			}
+			if !claimed {
+				continue
+			}
+			pollCtx, cancel := context.WithTimeout(ctx, subscriptionTimeout)
+			title, err := pollSubscription(pollCtx, s)
+			cancel()
+			lastError := ""
+			if err != nil {
+				lastError = truncate(err.Error(), maxErrorMsgLen)
+			}
+			if err := dao.FinishSubscriptionPoll(s.ID, title, lastError); err != nil {
+				log.Error("finish subscription:%d poll err:%v", s.ID, err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"minodl/models"
+	"testing"
+)
+
+func TestMatchSubscription(t *testing.T) {
+	cases := []struct {
+		name        string
+		keyword     string
+		maxDuration int
+		entry       models.PlaylistEntry
+		want        bool
+	}{
+		{"no filter", "", 0, models.PlaylistEntry{Title: "anything", Duration: 7200}, true},
+		{"keyword ignores case", "Vlog", 0, models.PlaylistEntry{Title: "Tokyo VLOG #3"}, true},
+		{"keyword missing", "vlog", 0, models.PlaylistEntry{Title: "Cooking at home"}, false},
+		{"chinese keyword", "教程", 0, models.PlaylistEntry{Title: "手冲咖啡教程"}, true},
+		{"under max duration", "", 600, models.PlaylistEntry{Duration: 599.5}, true},
+		{"at max duration", "", 600, models.PlaylistEntry{Duration: 600}, true},
+		{"over max duration", "", 600, models.PlaylistEntry{Duration: 600.5}, false},
+		// 时长未知的不过滤
+		{"unknown duration", "", 600, models.PlaylistEntry{Title: "live"}, true},
+		{"both match", "vlog", 600, models.PlaylistEntry{Title: "vlog", Duration: 300}, true},
+		{"keyword matches, too long", "vlog", 600, models.PlaylistEntry{Title: "vlog", Duration: 900}, false},
+	}
+	for _, c := range cases {
+		s := &models.Subscription{Keyword: c.keyword, MaxDuration: c.maxDuration}
+		if got := matchSubscription(s, c.entry); got != c.want {
+			t.Errorf("%s: matchSubscription = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSubscriptionURL(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"https://www.youtube.com/@somechannel", "https://www.youtube.com/@somechannel/videos"},
+		{"https://www.youtube.com/@somechannel/", "https://www.youtube.com/@somechannel/videos"},
+		{"https://youtube.com/channel/UC1234567890abcdef", "https://youtube.com/channel/UC1234567890abcdef/videos"},
+		{"https://m.youtube.com/c/SomeName", "https://m.youtube.com/c/SomeName/videos"},
+		{"https://www.youtube.com/user/someuser", "https://www.youtube.com/user/someuser/videos"},
+		// 已经是某个标签页或播放列表时不改
+		{"https://www.youtube.com/@somechannel/videos", "https://www.youtube.com/@somechannel/videos"},
+		{"https://www.youtube.com/@somechannel/shorts", "https://www.youtube.com/@somechannel/shorts"},
+		{"https://www.youtube.com/playlist?list=PL123", "https://www.youtube.com/playlist?list=PL123"},
+		{"https://www.youtube.com/watch?v=abc", "https://www.youtube.com/watch?v=abc"},
+		{"https://space.bilibili.com/12345/video", "https://space.bilibili.com/12345/video"},
+		{"https://notyoutube.com/@somechannel", "https://notyoutube.com/@somechannel"},
+		{"::not a url", "::not a url"},
+	}
+	for _, c := range cases {
+		if got := subscriptionURL(c.in); got != c.want {
+			t.Errorf("subscriptionURL(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
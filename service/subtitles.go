@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"minodl/models"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 字幕格式和使用方式
+const (
+	SubtitleSRT = "srt"
+	SubtitleVTT = "vtt"
+
+	SubtitleEmbed = "embed" // 作为软字幕封装进 MP4
+	SubtitleBurn  = "burn"  // 烧录到画面，需要重新编码
+)
+
+var subtitleLangRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// SubtitleOptions 创建任务时选择的字幕
+type SubtitleOptions struct {
+	Langs  []string `json:"langs"`  // 语言代码，见解析结果中的 subtitles
+	Auto   bool     `json:"auto"`   // 没有人工字幕时允许使用自动生成的字幕
+	Format string   `json:"format"` // srt | vtt，默认 srt
+	Mode   string   `json:"mode"`   // 为空时只下载字幕文件；embed | burn
+}
+
+// buildSubtitles 汇总人工字幕和自动字幕，人工字幕在前
+func buildSubtitles(manual, auto map[string][]models.SubtitleFormat) []models.Subtitle {
+	out := make([]models.Subtitle, 0, len(manual)+len(auto))
+	add := func(tracks map[string][]models.SubtitleFormat, isAuto bool) {
+		for lang, formats := range tracks {
+			// YouTube 直播聊天记录不是字幕
+			if lang == "live_chat" || len(formats) == 0 {
+				continue
+			}
+			s := models.Subtitle{Lang: lang, Name: formats[0].Name, Auto: isAuto}
+			for _, f := range formats {
+				s.Formats = append(s.Formats, f.Ext)
+			}
+			out = append(out, s)
+		}
+	}
+	add(manual, false)
+	add(auto, true)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Auto != out[j].Auto {
+			return !out[i].Auto
+		}
+		return out[i].Lang < out[j].Lang
+	})
+	return out
+}
+
+// applySubtitleOptions 校验字幕选项并写入任务，available 为 nil 时（播放列表条目）不检查语言是否存在
+func applySubtitleOptions(t *models.Task, opts *SubtitleOptions, available []models.Subtitle) error {
+	if opts == nil || len(opts.Langs) == 0 {
+		return nil
+	}
+	format := opts.Format
+	if format == "" {
+		format = SubtitleSRT
+	}
+	if format != SubtitleSRT && format != SubtitleVTT {
+		return errors.New("subtitle format must be srt or vtt")
+	}
+	if opts.Mode != "" && opts.Mode != SubtitleEmbed && opts.Mode != SubtitleBurn {
+		return errors.New("subtitle mode must be embed or burn")
+	}
+	for _, lang := range opts.Langs {
+		if !subtitleLangRe.MatchString(lang) {
+			return fmt.Errorf("invalid subtitle language: %s", lang)
+		}
+		if available != nil && !hasSubtitle(available, lang, opts.Auto) {
+			return fmt.Errorf("subtitle %s not available", lang)
+		}
+	}
+	t.SubLangs = strings.Join(opts.Langs, ",")
+	t.SubAuto = opts.Auto
+	t.SubFormat = format
+	t.SubMode = opts.Mode
+	return nil
+}
+
+func hasSubtitle(available []models.Subtitle, lang string, auto bool) bool {
+	for _, s := range available {
+		if s.Lang == lang && (!s.Auto || auto) {
+			return true
+		}
+	}
+	return false
+}
+
+// SubtitleKey 任务中某种语言字幕文件的存储 key，没有时返回空字符串
+func SubtitleKey(t *models.Task, lang string) string {
+	for _, key := range t.SubtitlePaths {
+		// media/<sha256>.<lang>.<ext>
+		parts := strings.Split(filepath.Base(key), ".")
+		if len(parts) >= 3 && parts[len(parts)-2] == lang {
+			return key
+		}
+	}
+	return ""
+}
+
+// subtitleVariant 字幕选项也决定下载结果，参与缓存 key
+func subtitleVariant(t *models.Task) string {
+	if t.SubLangs == "" {
+		return ""
+	}
+	return fmt.Sprintf("sub:%s:%t:%s:%s", t.SubLangs, t.SubAuto, t.SubFormat, t.SubMode)
+}
+
+// taskSubtitles 任务保存的字幕选项，没有选择字幕时返回 nil
+func taskSubtitles(t *models.Task) *SubtitleOptions {
+	if t.SubLangs == "" {
+		return nil
+	}
+	return &SubtitleOptions{
+		Langs:  strings.Split(t.SubLangs, ","),
+		Auto:   t.SubAuto,
+		Format: t.SubFormat,
+		Mode:   t.SubMode,
+	}
+}
+
+// subtitleArgs yt-dlp 字幕参数，同一语言有人工字幕时优先使用人工字幕
+func subtitleArgs(opts *SubtitleOptions) []string {
+	if opts == nil || len(opts.Langs) == 0 {
+		return nil
+	}
+	args := []string{"--sub-langs", strings.Join(opts.Langs, ","), "--write-subs"}
+	if opts.Auto {
+		args = append(args, "--write-auto-subs")
+	}
+	args = append(args, "--convert-subs", opts.Format)
+	if opts.Mode == SubtitleEmbed {
+		args = append(args, "--embed-subs", "--merge-output-format", "mp4")
+	}
+	return args
+}
+
+// collectSubtitles yt-dlp 写出的字幕文件 <id>.<lang>.<ext>，封装进视频后不再单独保留
+func collectSubtitles(t *models.Task) []string {
+	if t.SubLangs == "" {
+		return nil
+	}
+	var out []string
+	for _, ext := range []string{SubtitleSRT, SubtitleVTT} {
+		matches, _ := filepath.Glob(filepath.Join(DownloadDir(), fmt.Sprintf("%d.*.%s", t.ID, ext)))
+		out = append(out, matches...)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// burnSubtitles 把第一种语言的字幕烧录到画面，返回新的视频文件
+func burnSubtitles(ctx context.Context, tracker *TaskTracker, input string, subtitles []string) (string, error) {
+	t := tracker.t
+	if len(subtitles) == 0 {
+		return "", errors.New("no subtitle downloaded")
+	}
+	sub := subtitles[0]
+	lang := strings.Split(t.SubLangs, ",")[0]
+	for _, s := range subtitles {
+		if strings.Contains(filepath.Base(s), "."+lang+".") {
+			sub = s
+			break
+		}
+	}
+	output := strings.TrimSuffix(input, extOf(input)) + ".burned.mp4"
+	args := []string{"-y", "-hide_banner", "-nostats", "-i", input,
+		"-vf", "subtitles='" + escapeFilterPath(sub) + "'",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "160k", "-movflags", "+faststart",
+		output,
+	}
+	if err := runFFmpeg(ctx, tracker, args); err != nil {
+		_ = os.Remove(output)
+		return "", err
+	}
+	_ = os.Remove(input)
+	return output, nil
+}
+
+// escapeFilterPath 路径放在滤镜参数的单引号里，只需处理单引号本身
+func escapeFilterPath(p string) string {
+	return strings.ReplaceAll(filepath.ToSlash(p), `'`, `'\''`)
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"minodl/config"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/storage"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	coverPrefix       = "covers/"
+	coverMaxBytes     = 10 << 20
+	coverFetchTimeout = 15 * time.Second
+	coverTTL          = 30 * 24 * time.Hour // 超过这么久没被解析到的封面会被清理
+	coverSweep        = time.Hour
+	coverSweepBatch   = 200
+	coverWorkers      = 4
+)
+
+var (
+	ErrCoverNotFound = errors.New("cover not found")
+
+	coverNameRe = regexp.MustCompile(`^[0-9a-f]{32}\.(jpg|jpeg|png|webp|gif)$`)
+	coverClient = &http.Client{Timeout: coverFetchTimeout}
+	coverSlots  = make(chan struct{}, coverWorkers)
+)
+
+// 正在抓取的封面，同一张只抓一次
+var coverFetches = struct {
+	sync.Mutex
+	m map[string]*coverFetch
+}{m: make(map[string]*coverFetch)}
+
+// coverFetch 一次抓取，done 关闭后 err 为结果
+type coverFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// needsCoverMirror YouTube、B 站的图片 CDN 不允许 App 直接引用，小红书的图片地址带时效签名
+func needsCoverMirror(videoUrl string) bool {
+	for _, host := range []string{YouTube, "youtu.be", BILIBILI, "b23.tv", XHS, "xhslink.com"} {
+		if strings.Contains(videoUrl, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// MirrorThumbnail 返回封面的镜像地址，后台抓取到存储；抓取完成前访问镜像地址会同步抓取
+func MirrorThumbnail(src string) string {
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return src
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".webp", ".gif":
+	default:
+		ext = ".jpg"
+	}
+	sum := sha256.Sum256([]byte(src))
+	name := hex.EncodeToString(sum[:16]) + ext
+	key := coverPrefix + name
+	ctx := context.Background()
+	if err = dao.TouchCover(ctx, key, src); err != nil {
+		log.Error("touch cover %s err:%v", key, err)
+		return src
+	}
+	go func() {
+		if _, err := storage.Store.Stat(ctx, key); err == nil {
+			return
+		}
+		coverSlots <- struct{}{}
+		defer func() { <-coverSlots }()
+		if err := fetchCover(ctx, key, src); err != nil {
+			log.Error("mirror cover %s err:%v", src, err)
+		}
+	}()
+	return coverURL(name)
+}
+
+func coverURL(name string) string {
+	return strings.TrimRight(config.Get().PublicURL, "/") + "/statics/" + coverPrefix + name
+}
+
+// OpenThumbnail 打开镜像的封面，还没抓取到时按记录的原始地址同步抓取
+func OpenThumbnail(ctx context.Context, name string) (storage.Object, error) {
+	if !coverNameRe.MatchString(name) {
+		return nil, ErrCoverNotFound
+	}
+	key := coverPrefix + name
+	obj, err := storage.Store.Open(ctx, key)
+	if !errors.Is(err, storage.ErrNotFound) {
+		return obj, err
+	}
+	src, err := dao.GetCoverSource(ctx, key)
+	if err != nil || src == "" {
+		return nil, ErrCoverNotFound
+	}
+	if err = fetchCover(ctx, key, src); err != nil {
+		return nil, err
+	}
+	return storage.Store.Open(ctx, key)
+}
+
+// fetchCover 下载封面写入存储，并发请求同一张封面时等待第一个完成并得到它的结果
+func fetchCover(ctx context.Context, key, src string) error {
+	coverFetches.Lock()
+	if f, ok := coverFetches.m[key]; ok {
+		coverFetches.Unlock()
+		select {
+		case <-f.done:
+			return f.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	f := &coverFetch{done: make(chan struct{})}
+	coverFetches.m[key] = f
+	coverFetches.Unlock()
+	defer func() {
+		coverFetches.Lock()
+		delete(coverFetches.m, key)
+		coverFetches.Unlock()
+		close(f.done)
+	}()
+	f.err = downloadCover(ctx, key, src)
+	return f.err
+}
+
+func downloadCover(ctx context.Context, key, src string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	// B 站图片 CDN 校验 Referer
+	if strings.Contains(req.URL.Host, "hdslb.com") {
+		req.Header.Set("Referer", "https://www.bilibili.com/")
+	}
+	resp, err := coverClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cover status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "image/") {
+		return fmt.Errorf("cover content type %s", ct)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, coverMaxBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > coverMaxBytes {
+		return errors.New("cover too large")
+	}
+	return storage.Store.Put(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// CleanThumbnails 删除长时间没有被解析到的封面
+func CleanThumbnails(ctx context.Context) (int, error) {
+	before := time.Now().Add(-coverTTL)
+	removed := 0
+	for ctx.Err() == nil {
+		keys, err := dao.ListStaleCovers(ctx, before, coverSweepBatch)
+		if err != nil || len(keys) == 0 {
+			return removed, err
+		}
+		for _, key := range keys {
+			ok, err := dao.RemoveStaleCover(ctx, key, before)
+			if err != nil {
+				return removed, err
+			}
+			if !ok {
+				continue
+			}
+			if err = storage.Store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Error("delete cover %s err:%v", key, err)
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// InitThumbnails 定期清理过期封面
+func InitThumbnails() *Janitor {
+	return startJanitor(coverSweep, func(ctx context.Context) {
+		if n, err := CleanThumbnails(ctx); err != nil {
+			log.Error("clean covers err:%v", err)
+		} else if n > 0 {
+			log.Info("cleaned %d covers", n)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 等待中的请求拿到第一个请求的错误，而不是当作成功
+func TestFetchCoverWaitersGetLeaderError(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	const callers = 3
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			errs <- fetchCover(context.Background(), "covers/test-leader-error.jpg", srv.URL+"/cover.jpg")
+		}()
+	}
+	// 所有请求都在等待同一次抓取
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		coverFetches.Lock()
+		f := coverFetches.m["covers/test-leader-error.jpg"]
+		coverFetches.Unlock()
+		mu.Lock()
+		started := requests
+		mu.Unlock()
+		if f != nil && started == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cover fetch did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err == nil {
+			t.Errorf("caller %d got nil error for a failed cover fetch", i)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("cover fetched %d times, want 1", requests)
+	}
+}
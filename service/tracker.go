@@ -0,0 +1,344 @@
+package service
+
+import (
+	"errors"
+	"math"
+	"minodl/dao"
+	"minodl/log"
+	"minodl/models"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tailLines      = 8
+	progressPrefix = "[progress]"
+)
+
+// 下载阶段
+const (
+	StageDownload    = "download"
+	StageMerge       = "merge"
+	StagePostprocess = "postprocess"
+)
+
+// yt-dlp 每行输出一条进度，未知的值为 NA
+const progressTemplate = "download:" + progressPrefix +
+	" %(progress.status)s %(progress.downloaded_bytes)s %(progress.total_bytes)s" +
+	" %(progress.total_bytes_estimate)s %(progress.speed)s %(progress.eta)s"
+
+var (
+	mergeRe     = regexp.MustCompile(`^\[Merger\]`)
+	errorLineRe = regexp.MustCompile(`^ERROR:\s*(.+)$`)
+)
+
+// ProgressArgs 让 yt-dlp 按 progressTemplate 逐行输出进度，由 TaskTracker.Line 解析
+func ProgressArgs() []string {
+	return []string{"--newline", "--progress", "--progress-template", progressTemplate}
+}
+
+// progressSample 一行进度输出
+type progressSample struct {
+	status     string // downloading | finished | error
+	downloaded int64
+	total      int64
+	speed      float64
+	eta        int
+}
+
+func parseProgressLine(line string) (progressSample, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), progressPrefix)
+	if !ok {
+		return progressSample{}, false
+	}
+	fields := strings.Fields(rest)
+	if len(fields) != 6 {
+		return progressSample{}, false
+	}
+	p := progressSample{
+		status:     fields[0],
+		downloaded: int64(parseNumber(fields[1])),
+		total:      int64(parseNumber(fields[2])),
+		speed:      parseNumber(fields[4]),
+		eta:        int(parseNumber(fields[5])),
+	}
+	// 分片下载只有预估大小
+	if p.total == 0 {
+		p.total = int64(parseNumber(fields[3]))
+	}
+	return p, true
+}
+
+// parseNumber NA 或无法解析时返回 0
+func parseNumber(s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0
+	}
+	return v
+}
+
+// TaskTracker 解析 yt-dlp stderr，节流持久化进度并推送任务事件
+type TaskTracker struct {
+	t        *models.Task
+	lastSave time.Time
+	lastErr  string
+	lastLine string
+	tail     []string  // 最近几行输出，用于归类失败原因
+	auth     *SiteAuth // 带登录信息下载时，被要求登录说明登录信息失效
+	worker   bool      // 队列下载的 tracker，写库前确认任务没有被取消
+	detached bool      // 推流的 tracker，只解析输出，不写任务也不推送事件
+}
+
+func NewTaskTracker(t *models.Task) *TaskTracker {
+	return &TaskTracker{t: t}
+}
+
+// newStreamTracker 推流和队列下载互不影响，推流只修改任务的副本
+func newStreamTracker(t *models.Task) *TaskTracker {
+	copied := *t
+	return &TaskTracker{t: &copied, detached: true}
+}
+
+// Line 处理一行 yt-dlp 输出
+func (tr *TaskTracker) Line(line string) {
+	if p, ok := parseProgressLine(line); ok {
+		tr.Progress(p)
+		return
+	}
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if mergeRe.MatchString(line) {
+		tr.SetStage(StageMerge)
+	}
+	tr.lastLine = line
+	if tr.tail = append(tr.tail, line); len(tr.tail) > tailLines {
+		tr.tail = tr.tail[1:]
+	}
+	if match := errorLineRe.FindStringSubmatch(line); len(match) == 2 {
+		tr.lastErr = match[1]
+		tr.publish(tr.event(EventError))
+	}
+}
+
+// Progress 更新下载进度，事件实时推送，写库最多每秒一次
+func (tr *TaskTracker) Progress(p progressSample) {
+	t := tr.t
+	t.Stage = StageDownload
+	t.DownloadedBytes = p.downloaded
+	t.TotalBytes = p.total
+	t.Speed = p.speed
+	t.ETA = p.eta
+	switch {
+	case p.status == "finished":
+		t.Progress = 100
+		t.Speed = 0
+		t.ETA = 0
+	case p.total > 0:
+		t.Progress = math.Min(roundPercent(float64(p.downloaded)/float64(p.total)*100), 100)
+	}
+	tr.publishProgress()
+}
+
+// SetStage 进入合并等没有字节进度的阶段
+func (tr *TaskTracker) SetStage(stage string) {
+	if tr.t.Stage == stage {
+		return
+	}
+	tr.t.Stage = stage
+	tr.t.Speed = 0
+	tr.t.ETA = 0
+	tr.lastSave = time.Time{}
+	tr.publishProgress()
+}
+
+func (tr *TaskTracker) publishProgress() {
+	if tr.t.Status == models.StatusCancelled {
+		return
+	}
+	if tr.t.Status != models.StatusRunning {
+		_ = tr.SetStatus(models.StatusRunning)
+		return
+	}
+	tr.publish(tr.event(EventProgress))
+	if time.Since(tr.lastSave) >= progressInterval {
+		_ = tr.save()
+		tr.lastSave = time.Now()
+		tr.refreshParent()
+	}
+}
+
+// StageProgress 后处理阶段的进度，与下载进度分开记录
+func (tr *TaskTracker) StageProgress(stage string, progress float64) {
+	if tr.t.Status == models.StatusCancelled {
+		return
+	}
+	tr.t.Stage = stage
+	tr.t.ProfileProgress = roundPercent(progress)
+	if tr.t.ProfileStatus != models.StatusRunning {
+		tr.t.ProfileStatus = models.StatusRunning
+		tr.lastSave = time.Time{}
+	}
+	ev := tr.event(EventProgress)
+	ev.Progress = tr.t.ProfileProgress
+	tr.publish(ev)
+	if time.Since(tr.lastSave) >= progressInterval || progress >= 100 {
+		_ = tr.save()
+		tr.lastSave = time.Now()
+	}
+}
+
+// SetStatus 持久化状态并推送状态变化
+func (tr *TaskTracker) SetStatus(status models.TaskStatus) error {
+	tr.t.Status = status
+	if status != models.StatusRunning {
+		tr.t.Speed = 0
+		tr.t.ETA = 0
+	}
+	if status == models.StatusCompleted {
+		tr.t.Progress = 100
+		tr.t.Stage = ""
+	}
+	err := tr.save()
+	tr.lastSave = time.Now()
+	if errors.Is(err, ErrTaskCancelled) {
+		return err
+	}
+	tr.publish(tr.event(EventStatus))
+	tr.refreshParent()
+	return err
+}
+
+func (tr *TaskTracker) publish(ev TaskEvent) {
+	if !tr.detached {
+		Events.Publish(ev)
+	}
+}
+
+// save 写库。队列下载只在任务仍在进行时写入，发现任务已被取消（可能在其它节点、
+// 取消事件没有送达）时不覆盖取消状态，并终止本节点的进程
+func (tr *TaskTracker) save() error {
+	if tr.detached {
+		return nil
+	}
+	if !tr.worker {
+		return dao.UpdateTask(tr.t)
+	}
+	active, err := dao.UpdateActiveTask(tr.t)
+	if err != nil {
+		return err
+	}
+	if !active {
+		tr.t.Status = models.StatusCancelled
+		cancelProcess(tr.t.ID)
+		return ErrTaskCancelled
+	}
+	return nil
+}
+
+func (tr *TaskTracker) refreshParent() {
+	if tr.t.ParentID != 0 && !tr.detached {
+		refreshParent(tr.t.ParentID)
+	}
+}
+
+// Fail 标记失败并归类原因，进程退出错误优先使用 yt-dlp 输出的错误信息
+func (tr *TaskTracker) Fail(err error) error {
+	err = tr.classify(err)
+	tr.t.NextRetryAt = nil
+	_ = tr.SetStatus(models.StatusFailed)
+	return err
+}
+
+// FailCode 非 yt-dlp 的失败，原因由调用方指定
+func (tr *TaskTracker) FailCode(code string, err error) error {
+	tr.t.ErrorCode = code
+	tr.t.ErrorMsg = truncate(err.Error(), maxErrorMsgLen)
+	tr.t.NextRetryAt = nil
+	_ = tr.SetStatus(models.StatusFailed)
+	return err
+}
+
+// FailOrRetry 网络、限流等临时错误按指数退避自动重试，超过次数后标记失败
+func (tr *TaskTracker) FailOrRetry(err error) error {
+	err = tr.classify(err)
+	if !IsTransient(tr.t.ErrorCode) || tr.t.Attempts >= maxAttempts || Queue == nil {
+		tr.t.NextRetryAt = nil
+		_ = tr.SetStatus(models.StatusFailed)
+		return err
+	}
+	at := time.Now().Add(retryDelay(tr.t.ErrorCode, tr.t.Attempts))
+	tr.t.NextRetryAt = &at
+	resetProgress(tr.t)
+	_ = tr.SetStatus(models.StatusPending)
+	Queue.PushAt(tr.t, at)
+	log.Info("task:%d %s, retry %d/%d at %s", tr.t.ID, tr.t.ErrorCode, tr.t.Attempts, maxAttempts, at.Format(time.DateTime))
+	return err
+}
+
+func (tr *TaskTracker) classify(err error) error {
+	orig := err
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if tr.lastErr != "" {
+			err = errors.New(tr.lastErr)
+		} else if tr.lastLine != "" {
+			err = errors.New(tr.lastLine)
+		}
+	}
+	tr.t.ErrorCode = ClassifyFailure(strings.Join(tr.tail, "\n")+"\n"+err.Error(), orig)
+	tr.t.ErrorMsg = truncate(err.Error(), maxErrorMsgLen)
+	if tr.t.ErrorCode == FailLoginRequired && tr.auth != nil {
+		tr.t.ErrorCode = FailCookiesExpired
+		credentialRejected(tr.auth, tr.t.ErrorMsg)
+	}
+	return err
+}
+
+// Cancel 标记任务已取消
+func (tr *TaskTracker) Cancel() error {
+	tr.t.ErrorMsg = ""
+	return tr.SetStatus(models.StatusCancelled)
+}
+
+func (tr *TaskTracker) event(typ string) TaskEvent {
+	ev := TaskEvent{
+		Type:            typ,
+		TaskID:          tr.t.ID,
+		UserID:          tr.t.UserID,
+		Status:          tr.t.Status,
+		Progress:        tr.t.Progress,
+		Stage:           tr.t.Stage,
+		DownloadedBytes: tr.t.DownloadedBytes,
+		TotalBytes:      tr.t.TotalBytes,
+		Speed:           tr.t.Speed,
+		ETA:             tr.t.ETA,
+	}
+	switch {
+	case typ == EventError:
+		ev.Error = tr.lastErr
+	case tr.t.Status == models.StatusFailed:
+		ev.Error = tr.t.ErrorMsg
+		ev.Code = tr.t.ErrorCode
+	}
+	return ev
+}
+
+// resetProgress 重新下载前清空进度
+func resetProgress(t *models.Task) {
+	t.Progress = 0
+	t.Stage = ""
+	t.DownloadedBytes = 0
+	t.TotalBytes = 0
+	t.Speed = 0
+	t.ETA = 0
+}
+
+// roundPercent 保留一位小数
+func roundPercent(v float64) float64 {
+	return math.Round(v*10) / 10
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minodl/log"
+	"minodl/models"
+	"path/filepath"
+	"strconv"
+)
+
+const ExtractorYtDlp = "yt-dlp"
+
+// YtDlp 调用 yt-dlp 命令
+type YtDlp struct{}
+
+func (YtDlp) Name() string { return ExtractorYtDlp }
+
+// yt-dlp 在已路由站点上的表现，其它站点按通用能力处理
+var ytdlpSites = map[string]Capabilities{
+	YouTube:  {Playlists: true, Subtitles: true, AudioOnly: true, MaxHeight: 4320},
+	BILIBILI: {Playlists: true, Subtitles: true, AudioOnly: true, MaxHeight: 2160}, // 1080P 以上需要大会员 cookie
+	DouYin:   {AudioOnly: true, MaxHeight: 1080},
+	XHS:      {AudioOnly: true, MaxHeight: 1080},
+}
+
+func (YtDlp) Capabilities(domain string) Capabilities {
+	if alias, ok := siteAliases[domain]; ok {
+		domain = alias
+	}
+	if c, ok := ytdlpSites[domain]; ok {
+		return c
+	}
+	return Capabilities{Playlists: true, Subtitles: true, AudioOnly: true}
+}
+
+func (YtDlp) Probe(ctx context.Context, videoUrl string, auth *SiteAuth) (*models.VideoInfo, error) {
+	// 会员、年龄限制等内容需要用户自己的 cookie
+	args, err := auth.ytdlpArgs()
+	if err != nil {
+		return nil, err
+	}
+	// 播放列表只取条目信息，不逐个解析
+	args = append(args, "--dump-single-json", "--flat-playlist",
+		"--playlist-end", strconv.Itoa(maxPlaylistEntries), videoUrl)
+	cmd := Command(ctx, "yt-dlp", args...)
+	// 捕获标准输出和标准错误
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	// 运行命令
+	err = cmd.Run()
+	if err != nil {
+		log.Error(fmt.Sprint(err) + ": " + stderr.String())
+		// 保留 yt-dlp 的错误信息，便于归类失败原因
+		if msg := lastNonEmptyLine(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	var videoInfo models.VideoInfo
+	// 解析JSON输出
+	if err = json.Unmarshal(out.Bytes(), &videoInfo); err != nil {
+		log.Error("解析JSON失败:%v", err)
+		return nil, err
+	}
+	return &videoInfo, nil
+}
+
+func (y YtDlp) Formats(ctx context.Context, videoUrl string, auth *SiteAuth) ([]models.VideoFormat, error) {
+	info, err := y.Probe(ctx, videoUrl, auth)
+	if err != nil {
+		return nil, err
+	}
+	return info.Formats, nil
+}
+
+// Download stderr 逐行交给 Tracker 解析进度；写文件时通过 --print 取得最终文件名
+func (YtDlp) Download(ctx context.Context, req DownloadRequest) (string, error) {
+	args, err := req.Auth.ytdlpArgs()
+	if err != nil {
+		return "", err
+	}
+	args = append(args, "-f", req.FormatSpec)
+	args = append(args, ProgressArgs()...)
+	args = append(args, subtitleArgs(req.Subtitles)...)
+	var stdout bytes.Buffer
+	if req.Writer != nil {
+		args = append(args, "-o", "-", req.URL)
+	} else {
+		output := filepath.Join(req.Dir, req.Name+".%(ext)s")
+		args = append(args, "--print", "after_move:filepath", "-o", output, req.URL)
+	}
+	cmd := Command(ctx, "yt-dlp", args...)
+	if req.Writer != nil {
+		cmd.Stdout = req.Writer
+	} else {
+		cmd.Stdout = &stdout
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	if err = cmd.Start(); err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		if req.Tracker != nil {
+			req.Tracker.Line(scanner.Text())
+		}
+	}
+	if err = cmd.Wait(); err != nil {
+		return "", err
+	}
+	if req.Writer != nil {
+		return "", nil
+	}
+	filePath := lastNonEmptyLine(stdout.String())
+	if filePath == "" {
+		return "", errors.New("yt-dlp did not report output file")
+	}
+	return filePath, nil
+}
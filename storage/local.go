@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultLocalDir = "./runtime/storage"
+
+// Local 本地磁盘存储
+type Local struct {
+	root    string
+	baseURL string
+}
+
+func NewLocal(root, baseURL string) (*Local, error) {
+	if root == "" {
+		root = defaultLocalDir
+	}
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Local{root: root, baseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// LocalPath 对象在磁盘上的路径，供 ffmpeg 等外部程序直接读取
+func (l *Local) LocalPath(key string) (string, error) {
+	return l.path(key)
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dst, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	// 先写临时文件再改名，读者不会看到写了一半的对象；临时文件名唯一，同一 key 并发写入互不干扰
+	f, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func (l *Local) PutFile(ctx context.Context, key, localPath string) error {
+	dst, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if err = os.Rename(localPath, dst); err == nil {
+		return nil
+	}
+	// 跨设备时退化为复制
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = l.Put(ctx, key, f, -1); err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+func (l *Local) Open(ctx context.Context, key string) (Object, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	st, err := f.Stat()
+	if err != nil || st.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return &localObject{File: f, info: fileInfo(st)}, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (Info, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		return Info{}, notFound(err)
+	}
+	return fileInfo(st), nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) URL(key string) string {
+	if l.baseURL == "" {
+		return ""
+	}
+	key, err := CleanKey(key)
+	if err != nil {
+		return ""
+	}
+	return l.baseURL + "/" + key
+}
+
+type localObject struct {
+	*os.File
+	info Info
+}
+
+func (o *localObject) Info() Info {
+	return o.info
+}
+
+func fileInfo(st os.FileInfo) Info {
+	return Info{
+		Size:    st.Size(),
+		ModTime: st.ModTime(),
+		ETag:    fmt.Sprintf(`"%x-%x"`, st.ModTime().UnixNano(), st.Size()),
+	}
+}
+
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
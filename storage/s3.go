@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"minodl/config"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	unsignedPayload   = "UNSIGNED-PAYLOAD"
+	amzDateFormat     = "20060102T150405Z"
+	defaultPresignTTL = time.Hour
+)
+
+// S3 兼容对象存储（AWS S3、MinIO、R2 等），使用 SigV4 签名
+type S3 struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	pathStyle  bool
+	baseURL    string
+	presignTTL time.Duration
+	client     *http.Client
+}
+
+func NewS3(sc config.StorageConfig) (*S3, error) {
+	if sc.Endpoint == "" || sc.Bucket == "" {
+		return nil, errors.New("s3 storage requires endpoint and bucket")
+	}
+	endpoint, err := url.Parse(sc.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	region := sc.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	ttl := time.Duration(sc.PresignTTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultPresignTTL
+	}
+	return &S3{
+		endpoint:   endpoint,
+		region:     region,
+		bucket:     sc.Bucket,
+		accessKey:  sc.AccessKey,
+		secretKey:  sc.SecretKey,
+		pathStyle:  sc.PathStyle,
+		baseURL:    strings.TrimRight(sc.BaseURL, "/"),
+		presignTTL: ttl,
+		client:     &http.Client{},
+	}, nil
+}
+
+// objectURL path-style: endpoint/bucket/key，virtual-hosted: bucket.endpoint/key
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return &u
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	// S3 单次 PUT 需要明确长度
+	if size < 0 {
+		return errors.New("s3 put requires object size")
+	}
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) PutFile(ctx context.Context, key, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err = s.Put(ctx, key, f, st.Size()); err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+func (s *S3) Open(ctx context.Context, key string) (Object, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	key, _ = CleanKey(key)
+	return &s3Object{s: s, ctx: ctx, key: key, info: info}, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return Info{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(key).String(), nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Info{Size: resp.ContentLength, ModTime: modTime, ETag: resp.Header.Get("ETag")}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// URL 配置了 CDN 地址时直接拼接，否则生成预签名地址
+func (s *S3) URL(key string) string {
+	key, err := CleanKey(key)
+	if err != nil {
+		return ""
+	}
+	if s.baseURL != "" {
+		return s.baseURL + "/" + key
+	}
+	return s.presign(http.MethodGet, key, s.presignTTL, time.Now())
+}
+
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s %s", req.Method, req.URL.Path, resp.Status, string(body))
+	}
+	return resp, nil
+}
+
+// sign 按 AWS SigV4 给请求加 Authorization 头，负载不参与签名
+func (s *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + unsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncodePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope, signature := s.signature(now, canonical)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// presign 生成查询参数签名的临时地址
+func (s *S3) presign(method, key string, ttl time.Duration, now time.Time) string {
+	u := s.objectURL(key)
+	amzDate := now.UTC().Format(amzDateFormat)
+	scope := now.UTC().Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.accessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+	canonical := strings.Join([]string{
+		method,
+		uriEncodePath(u.Path),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	_, signature := s.signature(now, canonical)
+	q.Set("X-Amz-Signature", signature)
+	u.RawQuery = canonicalQuery(q)
+	return u.String()
+}
+
+func (s *S3) signature(now time.Time, canonicalRequest string) (string, string) {
+	day := now.UTC().Format("20060102")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.UTC().Format(amzDateFormat) + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func uriEncodePath(p string) string {
+	return uriEncode(p, false)
+}
+
+// uriEncode SigV4 要求的编码：只保留非保留字符，路径中的 / 不编码
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// s3Object 按需发起 Range GET，Seek 只移动偏移量
+type s3Object struct {
+	s      *S3
+	ctx    context.Context
+	key    string
+	info   Info
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Info() Info {
+	return o.info
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.info.Size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := http.NewRequestWithContext(o.ctx, http.MethodGet, o.s.objectURL(o.key).String(), nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+		resp, err := o.s.do(req)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = o.offset + offset
+	case io.SeekEnd:
+		next = o.info.Size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if next < 0 {
+		return 0, errors.New("negative position")
+	}
+	if next != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = next
+	return next, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
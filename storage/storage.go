@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"minodl/config"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	DriverLocal = "local"
+	DriverS3    = "s3"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid storage key")
+)
+
+// Store 全局媒体存储，dl 服务启动时初始化
+var Store Storage
+
+// Info 对象元数据
+type Info struct {
+	Size    int64
+	ModTime time.Time
+	ETag    string
+}
+
+// Object 可随机读取的存储对象，用于 Range 请求
+type Object interface {
+	io.ReadSeekCloser
+	Info() Info
+}
+
+// Storage 媒体存储后端，Task.FilePath 保存的是 key 而不是磁盘路径
+type Storage interface {
+	// Put 写入对象
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// PutFile 把本地文件移动到存储中，成功后本地文件不再保留
+	PutFile(ctx context.Context, key, localPath string) error
+	Open(ctx context.Context, key string) (Object, error)
+	Stat(ctx context.Context, key string) (Info, error)
+	Delete(ctx context.Context, key string) error
+	// URL 对象的公开访问地址，没有公开地址时返回空字符串
+	URL(key string) string
+}
+
+// Init 根据配置选择存储后端
+func Init(cfg *config.Config) (Storage, error) {
+	sc := cfg.Storage
+	var err error
+	switch sc.Driver {
+	case "", DriverLocal:
+		Store, err = NewLocal(sc.LocalDir, sc.BaseURL)
+	case DriverS3:
+		Store, err = NewS3(sc)
+	default:
+		err = fmt.Errorf("unknown storage driver: %s", sc.Driver)
+	}
+	return Store, err
+}
+
+// CleanKey 规范化 key，拒绝跳出存储根目录的路径
+func CleanKey(key string) (string, error) {
+	key = strings.TrimLeft(path.Clean("/"+strings.ReplaceAll(key, "\\", "/")), "/")
+	if key == "" || key == "." {
+		return "", ErrInvalidKey
+	}
+	return key, nil
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+const maxFilenameRunes = 120
+
+// SanitizeFilename 去掉控制字符、路径分隔符等不能出现在文件名里的字符
+func SanitizeFilename(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsControl(r):
+			continue
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			sb.WriteRune('_')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	out := strings.Trim(strings.TrimSpace(sb.String()), ".")
+	// 超长时截断主文件名，保留扩展名
+	if runes := []rune(out); len(runes) > maxFilenameRunes {
+		ext := []rune(filepath.Ext(out))
+		out = string(runes[:maxFilenameRunes-len(ext)]) + string(ext)
+	}
+	return out
+}
+
+// ContentDisposition 生成带 RFC 5987 UTF-8 文件名的 Content-Disposition
+// kind: inline 或 attachment
+func ContentDisposition(kind, filename string) string {
+	filename = SanitizeFilename(filename)
+	if filename == "" {
+		filename = "video"
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, kind, asciiFallback(filename), rfc5987Encode(filename))
+}
+
+// 旧客户端只认 filename=，非 ASCII 字符替换成下划线
+func asciiFallback(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		if r > unicode.MaxASCII || r == '%' {
+			sb.WriteRune('_')
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+func rfc5987Encode(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if b < unicode.MaxASCII && (('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9') || strings.IndexByte(attrChars, b) >= 0) {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}